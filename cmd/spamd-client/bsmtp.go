@@ -0,0 +1,124 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	bsmtpErr = "Invalid BSMTP transaction: %s"
+)
+
+// A bsmtp is a BSMTP transaction split around its DATA payload
+type bsmtp struct {
+	// pre is the envelope up to and including the DATA line
+	pre []byte
+	// msg is the message with the dot-stuffing removed
+	msg []byte
+	// post is what follows the terminating dot
+	post []byte
+	// eol is the line ending of the transaction
+	eol []byte
+}
+
+// A bsmtpError is returned when the input is not a BSMTP transaction
+type bsmtpError struct {
+	reason string
+}
+
+func (e *bsmtpError) Error() string {
+	return fmt.Sprintf(bsmtpErr, e.reason)
+}
+
+// parseBSMTP parses the transaction b, the envelope must have a
+// MAIL FROM and at least one RCPT TO before DATA
+func parseBSMTP(b []byte) (t *bsmtp, err error) {
+	var from, rcpt bool
+	var line []byte
+
+	t = &bsmtp{eol: []byte("\n")}
+	i := 0
+	for {
+		if line, i = nextLine(b, i); line == nil {
+			err = &bsmtpError{"no DATA command"}
+			return
+		}
+		cmd := bytes.ToUpper(bytes.TrimRight(line, "\r\n"))
+		switch {
+		case bytes.HasPrefix(cmd, []byte("MAIL FROM:")):
+			from = true
+		case bytes.HasPrefix(cmd, []byte("RCPT TO:")):
+			if !from {
+				err = &bsmtpError{"RCPT TO before MAIL FROM"}
+				return
+			}
+			rcpt = true
+		case bytes.Equal(bytes.TrimSpace(cmd), []byte("DATA")):
+			if !rcpt {
+				err = &bsmtpError{"DATA before RCPT TO"}
+				return
+			}
+			if bytes.HasSuffix(line, []byte("\r\n")) {
+				t.eol = []byte("\r\n")
+			}
+			t.pre = b[:i]
+			for {
+				if line, i = nextLine(b, i); line == nil {
+					err = &bsmtpError{"no terminating dot"}
+					return
+				}
+				if bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte(".")) {
+					t.post = b[i:]
+					return
+				}
+				if line[0] == '.' {
+					line = line[1:]
+				}
+				t.msg = append(t.msg, line...)
+			}
+		}
+	}
+}
+
+// nextLine returns the line of b starting at i with its line
+// ending and the start of the following line, nil at the end
+func nextLine(b []byte, i int) ([]byte, int) {
+	if i >= len(b) {
+		return nil, i
+	}
+	j := bytes.IndexByte(b[i:], '\n')
+	if j == -1 {
+		return b[i:], len(b)
+	}
+	return b[i : i+j+1], i + j + 1
+}
+
+// encode returns the transaction with msg as its payload, the
+// lines starting with a dot are stuffed
+func (t *bsmtp) encode(msg []byte) []byte {
+	var buf bytes.Buffer
+	var line []byte
+
+	buf.Write(t.pre)
+	for i := 0; ; {
+		if line, i = nextLine(msg, i); line == nil {
+			break
+		}
+		if line[0] == '.' {
+			buf.WriteByte('.')
+		}
+		buf.Write(line)
+	}
+	if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+		buf.Write(t.eol)
+	}
+	buf.WriteByte('.')
+	buf.Write(t.eol)
+	buf.Write(t.post)
+	return buf.Bytes()
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+const testBSMTP = "HELO relay.example.com\r\n" +
+	"MAIL FROM:<sender@example.com>\r\n" +
+	"RCPT TO:<rcpt1@example.net>\r\n" +
+	"rcpt to:<rcpt2@example.net>\r\n" +
+	"DATA\r\n" +
+	"Subject: test\r\n" +
+	"\r\n" +
+	"..leading dot\r\n" +
+	"body\r\n" +
+	".\r\n" +
+	"QUIT\r\n"
+
+func TestParseBSMTP(t *testing.T) {
+	tx, e := parseBSMTP([]byte(testBSMTP))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if msg := "Subject: test\r\n\r\n.leading dot\r\nbody\r\n"; string(tx.msg) != msg {
+		t.Errorf("Got %q want %q", tx.msg, msg)
+	}
+	if string(tx.post) != "QUIT\r\n" {
+		t.Errorf("Got %q want %q", tx.post, "QUIT\r\n")
+	}
+	if b := tx.encode(tx.msg); string(b) != testBSMTP {
+		t.Errorf("Got %q want %q", b, testBSMTP)
+	}
+	// the payload is terminated and the dots stuffed
+	want := testBSMTP[:len(testBSMTP)-len("Subject: test\r\n\r\n..leading dot\r\nbody\r\n.\r\nQUIT\r\n")] +
+		"X-Spam-Flag: YES\r\n\r\n..\r\nlast\r\n.\r\nQUIT\r\n"
+	if b := tx.encode([]byte("X-Spam-Flag: YES\r\n\r\n.\r\nlast")); string(b) != want {
+		t.Errorf("Got %q want %q", b, want)
+	}
+}
+
+func TestParseBSMTPLF(t *testing.T) {
+	in := "MAIL FROM:<a@example.com>\nRCPT TO:<b@example.com>\nDATA\nSubject: x\n\nbody\n.\n"
+	tx, e := parseBSMTP([]byte(in))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if string(tx.eol) != "\n" {
+		t.Errorf("Got %q want %q", tx.eol, "\n")
+	}
+	if b := tx.encode([]byte("Subject: x\n\nbody")); string(b) != in {
+		t.Errorf("Got %q want %q", b, in)
+	}
+}
+
+func TestParseBSMTPErrors(t *testing.T) {
+	tests := []string{
+		"Subject: test\r\n\r\nbody\r\n",
+		"RCPT TO:<b@example.com>\r\nDATA\r\n",
+		"MAIL FROM:<a@example.com>\r\nDATA\r\nbody\r\n.\r\n",
+		"MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nbody\r\n",
+	}
+	for _, in := range tests {
+		_, e := parseBSMTP([]byte(in))
+		var be *bsmtpError
+		if !errors.As(e, &be) {
+			t.Errorf("%q: got %v want a bsmtpError", in, e)
+		}
+	}
+}
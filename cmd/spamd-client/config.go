@@ -0,0 +1,56 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	flag "github.com/spf13/pflag"
+)
+
+// loadConfig applies the options of the spamc.conf file at p to
+// the flags not given on the command line, the default file is
+// read when p is empty and it exists
+func loadConfig(fs *flag.FlagSet, p string) (err error) {
+	var sc *spamdclient.SpamcConfig
+
+	if p == "" {
+		if _, err = os.Stat(spamdclient.DefaultSpamcConfig); err != nil {
+			err = nil
+			return
+		}
+		p = spamdclient.DefaultSpamcConfig
+	}
+	if sc, err = spamdclient.LoadSpamcConfig(p); err != nil {
+		return
+	}
+
+	changed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		changed[f.Name] = true
+	})
+	for _, o := range sc.Options {
+		if changed[o.Name] {
+			continue
+		}
+		f := fs.Lookup(o.Name)
+		if f == nil {
+			err = &spamdclient.ConfigError{Line: o.Line, Reason: "unsupported option " + o.Name}
+			return
+		}
+		v := o.Value
+		if v == "" {
+			v = f.NoOptDefVal
+		}
+		if err = fs.Set(o.Name, v); err != nil {
+			err = &spamdclient.ConfigError{Line: o.Line, Reason: fmt.Sprintf("invalid value for %s: %s", o.Name, err)}
+			return
+		}
+	}
+	return
+}
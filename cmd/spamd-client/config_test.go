@@ -0,0 +1,95 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	flag "github.com/spf13/pflag"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	dir, e := ioutil.TempDir("", "spamd-client")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	p := filepath.Join(dir, "spamc.conf")
+	if e = ioutil.WriteFile(p, []byte(s), 0644); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	return p
+}
+
+func TestLoadConfig(t *testing.T) {
+	var dest []string
+	var port int
+	var check, exitCode bool
+	var ssl string
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringSliceVarP(&dest, "dest", "d", []string{"localhost"}, "")
+	fs.IntVarP(&port, "port", "p", 783, "")
+	fs.BoolVarP(&check, "check", "c", false, "")
+	fs.BoolVarP(&exitCode, "exitcode", "E", false, "")
+	fs.StringVarP(&ssl, "ssl", "S", "", "")
+	fs.Lookup("ssl").NoOptDefVal = "tlsv1"
+
+	p := writeConfig(t, "# test\n-d spamd1,spamd2\n-d spamd3\n-p 1783\n-cS\n")
+	if e := fs.Parse([]string{"-p", "2783"}); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if e := loadConfig(fs, p); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if want := []string{"spamd1", "spamd2", "spamd3"}; !reflect.DeepEqual(dest, want) {
+		t.Errorf("Got %v want %v", dest, want)
+	}
+	// the command line wins
+	if port != 2783 {
+		t.Errorf("Got %d want %d", port, 2783)
+	}
+	if !check || exitCode {
+		t.Errorf("Got check %t exitcode %t want true false", check, exitCode)
+	}
+	if ssl != "tlsv1" {
+		t.Errorf("Got %q want %q", ssl, "tlsv1")
+	}
+
+	if e := loadConfig(fs, filepath.Join(filepath.Dir(p), "missing")); !os.IsNotExist(e) {
+		t.Errorf("Got %v want a not exist error", e)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		conf string
+		line int
+	}{
+		// known to spamc.conf but not defined by the flag set
+		{"-c\n--headers\n", 2},
+		{"-p http\n", 1},
+		{"--bogus\n", 1},
+	}
+	for _, tt := range tests {
+		var port int
+		var check bool
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.IntVarP(&port, "port", "p", 783, "")
+		fs.BoolVarP(&check, "check", "c", false, "")
+
+		var ce *spamdclient.ConfigError
+		if e := loadConfig(fs, writeConfig(t, tt.conf)); !errors.As(e, &ce) || ce.Line != tt.line {
+			t.Errorf("%q: got %v want an error at line %d", tt.conf, e, tt.line)
+		}
+	}
+}
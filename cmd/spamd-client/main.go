@@ -10,7 +10,7 @@ spamd-client - Golang Spamd SpamAssassin Client
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -18,7 +18,6 @@ import (
 	"log"
 	"math/rand"
 	"net"
-	"net/textproto"
 	"os"
 	"os/user"
 	"path"
@@ -35,11 +34,16 @@ import (
 const (
 	maxMsgSize      int64 = (256 * 1024 * 1024)
 	defaultUnixSock       = "/var/run/spamassassin/spamd.sock"
+	// exIsSpam is the exit code for spam with -c and -E
+	exIsSpam response.StatusCode = 1
 )
 
 var (
 	cfg     *Config
 	cmdName string
+	// out receives the output, it is buffered for --pipe-to
+	out     io.Writer = os.Stdout
+	pipeBuf bytes.Buffer
 )
 
 // Config represents the configuration flags
@@ -51,6 +55,7 @@ type Config struct {
 	Config              string
 	Randomize           bool
 	LogToStdErr         bool
+	Debug               bool
 	LearnType           string
 	ReportType          string
 	Port                int
@@ -62,6 +67,9 @@ type Config struct {
 	FilterRetry         int
 	FilterSleep         int
 	TLSVersion          string
+	TLSCert             string
+	TLSKey              string
+	TLSCAFile           string
 	TimeOut             int
 	ConnTimeOut         int
 	User                string
@@ -91,18 +99,29 @@ func init() {
 	flag.IntVarP(&cfg.Port, "port", "p", 783,
 		`In TCP/IP mode, connect to spamd server listening on given port
 `)
-	flag.StringVarP(&cfg.TLSVersion, "ssl", "S", "tlsv1",
-		`Use SSL to talk to spamd.`)
+	flag.StringVarP(&cfg.TLSVersion, "ssl", "S", "",
+		`Use SSL to talk to spamd, optionally giving
+the minimum version: tlsv1, tlsv1.1, tlsv1.2
+or tlsv1.3.`)
+	flag.Lookup("ssl").NoOptDefVal = "tlsv1"
+	flag.StringVar(&cfg.TLSCert, "ssl-cert", "",
+		`Client certificate to present to spamd.`)
+	flag.StringVar(&cfg.TLSKey, "ssl-key", "",
+		`Private key of the client certificate.`)
+	flag.StringVar(&cfg.TLSCAFile, "ssl-ca-file", "",
+		`CA certificates used to verify spamd.`)
 	flag.StringVarP(&cfg.UnixSocket, "socket", "U", "",
 		`Connect to spamd via UNIX domain sockets.`)
 	flag.StringVarP(&cfg.Config, "config", "F", "",
-		`Use this configuration file.`)
+		`Use this configuration file, the default is
+`+spamdclient.DefaultSpamcConfig+`
+when it exists.`)
 	flag.IntVarP(&cfg.TimeOut, "timeout", "t", 600,
 		`Timeout in seconds for communications to
-spamd.`)
+spamd, 0 disables it.`)
 	flag.IntVarP(&cfg.ConnTimeOut, "connect-timeout", "n", 600,
 		`Timeout in seconds when opening a connection to
-spamd.`)
+spamd, 0 disables it.`)
 	flag.IntVar(&cfg.FilterRetry, "filter-retries", 1,
 		`Retry filtering this many times if the spamd
 process fails (usually times out)`)
@@ -155,13 +174,17 @@ instead of bouncing with a permanent SMTP
 error.`)
 	flag.BoolVarP(&cfg.LogToStdErr, "log-to-stderr", "l", false,
 		`Log errors and warnings to stderr.`)
+	flag.BoolVarP(&cfg.Debug, "debug", "D", false,
+		`Log debug messages to stderr, including the
+address that served the request.`)
 	flag.StringVarP(&cfg.PipeCmd, "pipe-to", "e", "",
 		`Pipe the output to the given command instead
-of stdout. This must be the last option. [Not Supported]`)
+of stdout. This must be the last option.`)
 	flag.BoolVarP(&cfg.Version, "version", "V", false,
 		`Print spamd-client version and exit.`)
 	flag.BoolVarP(&cfg.KeepAliceCheck, "send-ping", "K", false,
-		`Keepalive check of spamd.`)
+		`Keepalive check of spamd, every destination is
+pinged and its round trip time printed.`)
 	flag.BoolVarP(&cfg.UseCompression, "use-compression", "z", false,
 		`Compress mail message sent to spamd.`)
 	flag.BoolVarP(&cfg.F, "compart-f", "f", false,
@@ -181,17 +204,31 @@ func usage() {
 
 func main() {
 	var err error
-	var m *os.File
-	var fi os.FileInfo
 	var u *user.User
 	var c *spamdclient.Client
-	var network, address string
+	var endpoints []spamdclient.Endpoint
 
 	flag.Usage = usage
 	flag.ErrHelp = errors.New("")
 	flag.CommandLine.SortFlags = false
-	flag.Parse()
-	// msg cleared when in ping action
+	args, cmdArgs := splitPipeArgs(flag.CommandLine, os.Args[1:])
+	flag.CommandLine.Parse(args)
+	if err = loadConfig(flag.CommandLine, cfg.Config); err != nil {
+		var ce *spamdclient.ConfigError
+		if errors.As(err, &ce) {
+			p := cfg.Config
+			if p == "" {
+				p = spamdclient.DefaultSpamcConfig
+			}
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", cmdName, p, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", cmdName, err)
+		}
+		os.Exit(int(response.ExConfig))
+	}
+	if cfg.PipeCmd != "" {
+		out = &pipeBuf
+	}
 	if cfg.Version {
 		fmt.Fprintf(os.Stdout, "SpamAssassin Client version %s SPAMC/%s\n", Version, spamdclient.ClientVersion)
 		os.Exit(0)
@@ -200,7 +237,8 @@ func main() {
 	if cfg.User == "current user" {
 		u, err = user.LookupId(strconv.Itoa(os.Geteuid()))
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintf(os.Stderr, "%s: %s\n", cmdName, err)
+			os.Exit(int(response.ExNpUser))
 		}
 		cfg.User = u.Username
 	}
@@ -239,176 +277,294 @@ func main() {
 		}
 	}
 
-	if len(cfg.Dest) == 0 && cfg.UnixSocket == "" {
+	if cfg.UnixSocket != "" {
+		endpoints = append(endpoints, spamdclient.Endpoint{Network: "unix", Address: cfg.UnixSocket})
+	} else if len(cfg.Dest) == 0 {
 		//None set, default to using default unix socket
 		if _, err = os.Stat(defaultUnixSock); os.IsNotExist(err) {
 			usageErr("%s: Please specify -d or -U")
 		}
-		network = "unix"
-		address = defaultUnixSock
-	} else if len(cfg.Dest) > 0 {
-		network = "tcp"
-		if cfg.UseIPv4 {
-			network = "tcp4"
-		}
-		if cfg.UseIPv6 {
-			network = "tcp6"
-		}
-		if network == "tcp" {
-			address = parseAddr(cfg.Dest[0], cfg.Port)
-		} else {
-			for _, addr := range cfg.Dest {
-				i := net.ParseIP(addr)
-				if i == nil {
-					address = parseAddr(addr, cfg.Port)
-					break
-				}
-				if network == "tcp6" && strings.Contains(addr, ":") {
-					address = parseAddr(addr, cfg.Port)
-					break
-				}
-				if network == "tcp4" && !strings.Contains(addr, ":") {
-					address = parseAddr(addr, cfg.Port)
-					break
-				}
-			}
-		}
+		endpoints = append(endpoints, spamdclient.Endpoint{Network: "unix", Address: defaultUnixSock})
+	}
+
+	ctx := context.Background()
+	if cfg.KeepAliceCheck {
+		// no message is read when pinging
+		finish(ping(ctx, endpoints), cmdArgs)
 	}
 
-	m = os.Stdin
-	fi, err = m.Stat()
+	input, big, err := readMessage(os.Stdin, cfg.MaxSize)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmdName, err)
+		os.Exit(int(response.ExIOErr))
 	}
-	if fi.Size() == 0 {
-		usage()
-		return
+	if big {
+		// too large to scan, passed through as is
+		finish(passThrough(input, os.Stdin), cmdArgs)
 	}
-	if fi.Size() > cfg.MaxSize {
-		log.Fatalf("The file is larger than max allowed")
+	msg := input
+	var tx *bsmtp
+	if cfg.Bsmtp {
+		// only the payload is scanned
+		if tx, err = parseBSMTP(input); err != nil {
+			fail(input, err, cmdArgs)
+		}
+		msg = tx.msg
 	}
+	m := bytes.NewReader(msg)
 
-	ctx := context.Background()
-	// Create spamdclient client instance
-	c, err = spamdclient.NewClient(network, address, cfg.User, cfg.UseCompression)
-	if err != nil {
-		log.Fatal(err)
+	if len(endpoints) == 0 {
+		if endpoints, err = resolveDests(ctx); err != nil {
+			fail(input, err, cmdArgs)
+		}
+	}
+	if c, err = newClient(endpoints); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmdName, err)
+		fail(input, err, cmdArgs)
 	}
-	c.SetConnTimeout(time.Duration(cfg.ConnTimeOut) * time.Second)
+	raw := &spamdclient.RequestOptions{RawBody: spamdclient.Bool(true)}
 
-	// var retcode int
-	var success bool
-	var code response.StatusCode
 	var rs *response.Response
-	for i := 0; i < cfg.FilterRetry; i++ {
-		success = false
-		if cfg.Check {
-			rs, err = c.Check(ctx, m)
-			if err != nil {
-				code = response.ExSoftware
-			} else {
-				if rs.StatusCode == response.ExOK {
-					success = true
-					fmt.Printf("%.1f/%.1f\n", rs.Score, rs.BaseScore)
-				}
-				code = rs.StatusCode
-			}
-		} else if cfg.Tests {
-			c.EnableRawBody()
-			rs, err = c.Symbols(ctx, m)
-			if err != nil {
-				code = response.ExSoftware
-			} else {
-				if rs.StatusCode == response.ExOK {
-					success = true
-					fmt.Printf("%s", rs.Raw)
-				}
-				code = rs.StatusCode
-			}
-			c.DisableRawBody()
-		} else if cfg.ReportIfSpam {
-			c.EnableRawBody()
-			rs, err = c.ReportIfSpam(ctx, m)
-			if err != nil {
-				code = response.ExSoftware
-			} else {
-				if rs.StatusCode == response.ExOK {
-					success = true
-					fmt.Printf("%.1f/%.1f\n", rs.Score, rs.BaseScore)
-					fmt.Printf("%s", rs.Raw)
-				}
-				code = rs.StatusCode
-			}
-			c.DisableRawBody()
-		} else if cfg.Report {
-			c.EnableRawBody()
-			rs, err = c.Report(ctx, m)
-			if err != nil {
-				code = response.ExSoftware
-			} else {
-				if rs.StatusCode == response.ExOK {
-					success = true
-					fmt.Printf("%.1f/%.1f\n", rs.Score, rs.BaseScore)
-					fmt.Printf("%s", rs.Raw)
-				}
-				code = rs.StatusCode
-			}
-			c.DisableRawBody()
-		} else if cfg.HeadersOnly {
-			c.EnableRawBody()
-			rs, err = c.Headers(ctx, m)
-			if err != nil {
-				code = response.ExSoftware
-			} else {
-				if rs.StatusCode == response.ExOK {
-					success = true
-					fmt.Printf("%s", rs.Raw)
-					tp := textproto.NewReader(bufio.NewReader(m))
-					_, err = tp.ReadMIMEHeader()
-					if err == nil {
-						for {
-							tmp, e := tp.R.ReadBytes('\n')
-							if e != nil {
-								break
-							}
-							fmt.Printf("%s", tmp)
-						}
-					}
-				}
-				code = rs.StatusCode
-			}
-			c.DisableRawBody()
-		} else if cfg.LearnType != "" || cfg.ReportType != "" {
-			success, code = tell(ctx, c, m)
+	if cfg.Check {
+		if rs, err = c.Check(ctx, m); err == nil {
+			fmt.Fprintf(out, "%.1f/%.1f\n", rs.Score, rs.BaseScore)
+		}
+	} else if cfg.Tests {
+		if rs, err = c.Do(ctx, request.Symbols, m, raw); err == nil {
+			fmt.Fprintf(out, "%s", rs.Raw)
+		}
+	} else if cfg.ReportIfSpam {
+		if rs, err = c.Do(ctx, request.ReportIfSpam, m, raw); err == nil {
+			fmt.Fprintf(out, "%.1f/%.1f\n", rs.Score, rs.BaseScore)
+			fmt.Fprintf(out, "%s", rs.Raw)
+		}
+	} else if cfg.Report {
+		if rs, err = c.Do(ctx, request.Report, m, raw); err == nil {
+			fmt.Fprintf(out, "%.1f/%.1f\n", rs.Score, rs.BaseScore)
+			fmt.Fprintf(out, "%s", rs.Raw)
 		}
-		// retcode = int(code)
-		if success && code == response.ExOK || !success && !code.IsTemp() {
-			break
+	} else if cfg.HeadersOnly {
+		if rs, err = c.Do(ctx, request.Headers, m, raw); err == nil {
+			// spamd returns the headers, the body is the original
+			err = emit(tx, append(rs.Raw, bodyOf(msg)...))
 		}
-		time.Sleep(time.Duration(cfg.RetrySleep) * time.Second)
+	} else if cfg.LearnType != "" || cfg.ReportType != "" {
+		err = tell(ctx, c, m)
+	} else {
+		rs, err = process(ctx, c, m, raw, tx)
+	}
+	if err != nil {
+		fail(input, err, cmdArgs)
+	}
+	finish(verdict(rs), cmdArgs)
+}
+
+// verdict returns EX_ISSPAM when the message is spam and -c or -E
+// is used, otherwise EX_OK
+func verdict(rs *response.Response) (code response.StatusCode) {
+	if rs != nil && rs.IsSpam && (cfg.Check || cfg.ExitCode) {
+		code = exIsSpam
+	}
+	return
+}
+
+// fail exits after a failed request, with safe fallback the
+// original input is written when filtering
+func fail(input []byte, err error, args []string) {
+	code := failed(input, err)
+	if cfg.DisableSafeFb {
+		os.Exit(int(code))
+	}
+	finish(code, args)
+}
+
+// finish exits with code, when --pipe-to is used the output is
+// written to the command and its exit status is used instead
+func finish(code response.StatusCode, args []string) {
+	if cfg.PipeCmd != "" {
+		code = pipeTo(&pipeBuf, cfg.PipeCmd, args)
 	}
-	// Exit with returned code
 	os.Exit(int(code))
 }
 
+// newClient returns a client trying the endpoints in order
+func newClient(endpoints []spamdclient.Endpoint) (c *spamdclient.Client, err error) {
+	opts := append(clientOptions(),
+		spamdclient.WithEndpoints(endpoints...),
+		spamdclient.WithBalancer(spamdclient.Ordered),
+	)
+	c, err = spamdclient.NewClientWithOptions(opts...)
+	return
+}
+
+// clientOptions returns the client options set by the flags
+func clientOptions() (opts []spamdclient.Option) {
+	opts = []spamdclient.Option{
+		spamdclient.WithUser(cfg.User),
+		spamdclient.WithConnTimeout(time.Duration(cfg.ConnTimeOut) * time.Second),
+		spamdclient.WithCmdTimeout(time.Duration(cfg.TimeOut) * time.Second),
+	}
+	if cfg.UseCompression {
+		opts = append(opts, spamdclient.WithCompression())
+	}
+	if cfg.ConnRetry > 1 {
+		opts = append(opts, spamdclient.WithConnRetries(cfg.ConnRetry-1))
+	}
+	if cfg.RetrySleep > 0 {
+		opts = append(opts, spamdclient.WithConnSleep(time.Duration(cfg.RetrySleep)*time.Second))
+	}
+	if cfg.FilterRetry > 1 {
+		opts = append(opts, spamdclient.WithRetryPolicy(spamdclient.RetryPolicy{
+			MaxAttempts:    cfg.FilterRetry,
+			InitialBackoff: time.Duration(cfg.FilterSleep) * time.Second,
+			Multiplier:     1,
+		}))
+	}
+	if flag.CommandLine.Changed("ssl") {
+		opts = append(opts, tlsOptions()...)
+	}
+	if cfg.LogToStdErr || cfg.Debug {
+		level := spamdclient.LevelWarn
+		if cfg.Debug {
+			level = spamdclient.LevelDebug
+		}
+		l := log.New(os.Stderr, cmdName+": ", 0)
+		opts = append(opts, spamdclient.WithLogger(spamdclient.NewStdLogger(l, level)))
+	}
+	return
+}
+
 func usageErr(s string) {
 	fmt.Fprintf(os.Stderr, s, cmdName)
 	flag.PrintDefaults()
 	os.Exit(int(response.ExUsage))
 }
 
-func parseAddr(a string, p int) (s string) {
-	i := net.ParseIP(a)
-	if i == nil {
-		s = fmt.Sprintf("%s:%d", a, p)
-	} else {
-		s = fmt.Sprintf("[%s]:%d", a, p)
+func tlsOptions() (opts []spamdclient.Option) {
+	v, err := spamdclient.ParseTLSVersion(cfg.TLSVersion)
+	if err != nil {
+		usageErr("%s: " + err.Error())
+	}
+	opts = append(opts, spamdclient.WithTLS(), spamdclient.WithTLSVersion(v, 0))
+	if len(cfg.Dest) == 1 && net.ParseIP(strings.Trim(cfg.Dest[0], "[]")) == nil {
+		// the endpoints are the resolved addresses of the host
+		opts = append(opts, spamdclient.WithServerName(cfg.Dest[0]))
+	}
+	if cfg.TLSCAFile != "" {
+		opts = append(opts, spamdclient.WithRootCA(cfg.TLSCAFile))
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		opts = append(opts, spamdclient.WithClientCert(cfg.TLSCert, cfg.TLSKey))
 	}
 	return
 }
 
-func tell(ctx context.Context, c *spamdclient.Client, m io.Reader) (succeeded bool, code response.StatusCode) {
-	var err error
+// errCode returns the EX_* code of a failed request, the status
+// returned by spamd or the code matching the failure
+func errCode(err error) (code response.StatusCode) {
+	var se *spamdclient.ServerError
+	var de *spamdclient.DialError
+	var pe *spamdclient.ProtocolError
+	var be *bsmtpError
+	var dnse *net.DNSError
+	var ne net.Error
+
+	switch {
+	case errors.As(err, &se):
+		code = se.Code
+	case errors.As(err, &de):
+		code = response.ExUnAvailable
+	case errors.As(err, &dnse):
+		code = response.ExNoHost
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &ne) && ne.Timeout():
+		code = response.ExTimeout
+	case errors.As(err, &pe):
+		code = response.ExProtocol
+	case errors.As(err, &be):
+		code = response.ExDataErr
+	case errors.Is(err, spamdclient.ErrNoResponse),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		code = response.ExIOErr
+	default:
+		code = response.ExSoftware
+	}
+	return
+}
+
+// failed returns the exit code of a failed request, with safe
+// fallback the original message is written when filtering and
+// EX_OK is returned
+func failed(msg []byte, err error) (code response.StatusCode) {
+	if cfg.Check {
+		// the score of an unscanned message
+		fmt.Fprint(out, "0/0\n")
+	}
+	if cfg.DisableSafeFb {
+		code = errCode(err)
+		if code == response.ExUnAvailable && cfg.UnavailableTempfail {
+			code = response.ExTempFail
+		}
+		return
+	}
+	if !filtering() {
+		return
+	}
+	if _, err = out.Write(msg); err != nil {
+		code = response.ExIOErr
+	}
+	return
+}
+
+// passThrough handles a message over the maximum size, it is not
+// scanned and is written unchanged when filtering
+func passThrough(msg []byte, r io.Reader) (code response.StatusCode) {
+	if cfg.Check {
+		fmt.Fprint(out, "0/0\n")
+	}
+	if !filtering() {
+		return
+	}
+	_, err := out.Write(msg)
+	if err == nil {
+		_, err = io.Copy(out, r)
+	}
+	if err != nil {
+		code = response.ExIOErr
+	}
+	return
+}
+
+// filtering returns true when the message is written to stdout
+func filtering() bool {
+	return !cfg.Check && !cfg.Tests && !cfg.ReportIfSpam && !cfg.Report &&
+		cfg.LearnType == "" && cfg.ReportType == ""
+}
+
+// process filters the message through spamd with a PROCESS
+// request and writes the result to stdout, the message is sent
+// verbatim so the output is what spamd returned byte for byte
+func process(ctx context.Context, c *spamdclient.Client, m io.Reader, o *spamdclient.RequestOptions, tx *bsmtp) (rs *response.Response, err error) {
+	v := *o
+	v.Verbatim = true
+	if rs, err = c.Do(ctx, request.Process, m, &v); err != nil {
+		return
+	}
+	err = emit(tx, rs.Raw)
+	return
+}
+
+// emit writes the filtered message b, as the payload of tx
+// in BSMTP mode
+func emit(tx *bsmtp, b []byte) (err error) {
+	if tx != nil {
+		b = tx.encode(b)
+	}
+	_, err = out.Write(b)
+	return
+}
+
+func tell(ctx context.Context, c *spamdclient.Client, m io.Reader) (err error) {
 	var h string
 	var l request.MsgType
 	var a request.TellAction
@@ -438,11 +594,10 @@ func tell(ctx context.Context, c *spamdclient.Client, m io.Reader) (succeeded bo
 		}
 		r, err = c.Tell(ctx, m, l, a)
 		if err != nil {
-			code = response.ExSoftware
 			return
 		}
-		code = r.StatusCode
 		if r.StatusCode != response.ExOK {
+			err = &spamdclient.ServerError{Code: r.StatusCode}
 			return
 		}
 		if cfg.LearnType != "" {
@@ -453,9 +608,9 @@ func tell(ctx context.Context, c *spamdclient.Client, m io.Reader) (succeeded bo
 				h = "Didset"
 			}
 			if f := r.Headers.Get(h); f != "" {
-				fmt.Println("Message successfully un/learned")
+				fmt.Fprintln(out, "Message successfully un/learned")
 			} else {
-				fmt.Println("Message was already un/learned")
+				fmt.Fprintln(out, "Message was already un/learned")
 			}
 			return
 		}
@@ -467,9 +622,9 @@ func tell(ctx context.Context, c *spamdclient.Client, m io.Reader) (succeeded bo
 				h = "Didset"
 			}
 			if f := r.Headers.Get(h); f != "" {
-				fmt.Println("Message successfully reported/revoked")
+				fmt.Fprintln(out, "Message successfully reported/revoked")
 			} else {
-				fmt.Println("Unable to report/revoke message")
+				fmt.Fprintln(out, "Unable to report/revoke message")
 			}
 			return
 		}
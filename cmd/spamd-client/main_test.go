@@ -0,0 +1,258 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+	"github.com/baruwa-enterprise/spamd-client/pkg/spamdtest"
+)
+
+// withConfig runs f with a copy of the configuration changed by
+// set and the output captured
+func withConfig(set func(c *Config), f func(buf *bytes.Buffer)) {
+	var buf bytes.Buffer
+
+	defer func(c Config, w io.Writer) {
+		*cfg, out = c, w
+	}(*cfg, out)
+	set(cfg)
+	out = &buf
+	f(&buf)
+}
+
+func TestVerdict(t *testing.T) {
+	spam := &response.Response{IsSpam: true}
+	ham := &response.Response{}
+	tests := []struct {
+		check    bool
+		exitCode bool
+		rs       *response.Response
+		code     response.StatusCode
+	}{
+		{false, false, spam, response.ExOK},
+		{true, false, spam, exIsSpam},
+		{false, true, spam, exIsSpam},
+		{true, false, ham, response.ExOK},
+		{false, true, ham, response.ExOK},
+		{true, true, nil, response.ExOK},
+	}
+	for _, tt := range tests {
+		withConfig(func(c *Config) {
+			c.Check, c.ExitCode = tt.check, tt.exitCode
+		}, func(buf *bytes.Buffer) {
+			if code := verdict(tt.rs); code != tt.code {
+				t.Errorf("-c %t -E %t: got %d want %d", tt.check, tt.exitCode, code, tt.code)
+			}
+		})
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	withConfig(func(c *Config) {
+		c.TimeOut, c.ConnTimeOut = 0, 0
+	}, func(buf *bytes.Buffer) {
+		opts := append(clientOptions(), spamdclient.WithEndpoint("tcp", "127.0.0.1:783"))
+		if _, e := spamdclient.NewClientWithOptions(opts...); e != nil {
+			t.Errorf("Unexpected error: %s", e)
+		}
+	})
+}
+
+func TestFailed(t *testing.T) {
+	msg := []byte("Subject: test\r\n\r\nbody\r\n")
+	err := &spamdclient.DialError{Network: "tcp", Address: "127.0.0.1:783"}
+	tests := []struct {
+		name string
+		set  func(c *Config)
+		code response.StatusCode
+		out  string
+	}{
+		{"filter", func(c *Config) {}, response.ExOK, string(msg)},
+		{"filter -E", func(c *Config) { c.ExitCode = true }, response.ExOK, string(msg)},
+		{"filter -x", func(c *Config) { c.DisableSafeFb = true }, response.ExUnAvailable, ""},
+		{"filter -x -X", func(c *Config) { c.DisableSafeFb, c.UnavailableTempfail = true, true }, response.ExTempFail, ""},
+		{"check", func(c *Config) { c.Check = true }, response.ExOK, "0/0\n"},
+		{"check -x", func(c *Config) { c.Check, c.DisableSafeFb = true, true }, response.ExUnAvailable, "0/0\n"},
+		{"symbols", func(c *Config) { c.Tests = true }, response.ExOK, ""},
+	}
+	for _, tt := range tests {
+		withConfig(tt.set, func(buf *bytes.Buffer) {
+			if code := failed(msg, err); code != tt.code {
+				t.Errorf("%s: got %d want %d", tt.name, code, tt.code)
+			}
+			if buf.String() != tt.out {
+				t.Errorf("%s: got %q want %q", tt.name, buf.String(), tt.out)
+			}
+		})
+	}
+}
+
+func TestNewClientFailure(t *testing.T) {
+	msg := []byte("Subject: test\r\n\r\nbody\r\n")
+	tests := []struct {
+		name string
+		set  func(c *Config)
+		code response.StatusCode
+		out  string
+	}{
+		{"check", func(c *Config) { c.Check = true }, response.ExOK, "0/0\n"},
+		{"check -x", func(c *Config) { c.Check, c.DisableSafeFb = true, true }, response.ExSoftware, "0/0\n"},
+		{"filter -E", func(c *Config) { c.ExitCode = true }, response.ExOK, string(msg)},
+		{"filter -E -x", func(c *Config) { c.ExitCode, c.DisableSafeFb = true, true }, response.ExSoftware, ""},
+	}
+	for _, tt := range tests {
+		withConfig(func(c *Config) {
+			tt.set(c)
+			c.TimeOut = -1
+		}, func(buf *bytes.Buffer) {
+			_, err := newClient([]spamdclient.Endpoint{{Network: "tcp", Address: "127.0.0.1:783"}})
+			if err == nil {
+				t.Fatalf("%s: an error should be returned", tt.name)
+			}
+			if code := failed(msg, err); code != tt.code {
+				t.Errorf("%s: got %d want %d", tt.name, code, tt.code)
+			}
+			if buf.String() != tt.out {
+				t.Errorf("%s: got %q want %q", tt.name, buf.String(), tt.out)
+			}
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	ctx := context.Background()
+	headers := "X-Spam-Flag: NO\r\nX-Spam-Status: No, score=0.0 required=5.0 tests=\r\n"
+	spamd := "X-Spam-Flag: NO\r\nSubject: test\r\n\r\nbody\r\n\r\n"
+	tests := []struct {
+		name string
+		set  func(c *Config)
+		msg  string
+		res  *spamdtest.Result
+		down bool
+		out  string
+	}{
+		{"plain", func(c *Config) {}, "Subject: test\r\n\r\nbody", nil, false,
+			headers + "Subject: test\r\n\r\nbody"},
+		{"-z", func(c *Config) { c.UseCompression = true }, "Subject: test\r\n\r\nbody", nil, false,
+			headers + "Subject: test\r\n\r\nbody"},
+		{"crlf", func(c *Config) {}, "Subject: test\r\n\r\nbody\r\n", nil, false,
+			headers + "Subject: test\r\n\r\nbody\r\n"},
+		{"-z crlf", func(c *Config) { c.UseCompression = true }, "Subject: test\r\n\r\nbody\r\n", nil, false,
+			headers + "Subject: test\r\n\r\nbody\r\n"},
+		{"spamd body", func(c *Config) {}, "Subject: test\r\n\r\nbody\r\n", &spamdtest.Result{Message: []byte(spamd)}, false,
+			spamd},
+		{"unavailable", func(c *Config) {}, "Subject: test\r\n\r\nbody\r\n", nil, true,
+			"Subject: test\r\n\r\nbody\r\n"},
+	}
+	for _, tt := range tests {
+		withConfig(tt.set, func(buf *bytes.Buffer) {
+			s := spamdtest.NewServer(spamdtest.Canned(tt.res))
+			if tt.down {
+				s.Close()
+			} else {
+				defer s.Close()
+			}
+			c, err := newClient([]spamdclient.Endpoint{s.Endpoint()})
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", tt.name, err)
+			}
+			o := &spamdclient.RequestOptions{RawBody: spamdclient.Bool(true)}
+			code := response.ExOK
+			if _, err = process(ctx, c, strings.NewReader(tt.msg), o, nil); err != nil {
+				if !tt.down {
+					t.Fatalf("%s: unexpected error: %s", tt.name, err)
+				}
+				code = failed([]byte(tt.msg), err)
+			}
+			if code != response.ExOK {
+				t.Errorf("%s: got %d want %d", tt.name, code, response.ExOK)
+			}
+			if buf.String() != tt.out {
+				t.Errorf("%s: got %q want %q", tt.name, buf.String(), tt.out)
+			}
+			if tt.down {
+				return
+			}
+			if rq := s.LastRequest(); string(rq.Body) != tt.msg {
+				t.Errorf("%s: spamd got %q want %q", tt.name, rq.Body, tt.msg)
+			}
+		})
+	}
+}
+
+// newGarbledServer answers every request with an invalid status line
+func newGarbledServer(t *testing.T) spamdclient.Endpoint {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ioutil.ReadAll(conn)
+			conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n"))
+			conn.Close()
+		}
+	}()
+	return spamdclient.Endpoint{Network: "tcp", Address: l.Addr().String()}
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	msg := "Subject: test\r\n\r\nbody\r\n"
+	s := spamdtest.NewServer(nil)
+	down := s.Endpoint()
+	s.Close()
+	garbled := newGarbledServer(t)
+	noFallback := func(c *Config) { c.DisableSafeFb = true }
+	badTimeout := func(c *Config) { c.TimeOut = -1 }
+	tests := []struct {
+		name string
+		set  func(c *Config)
+		ep   spamdclient.Endpoint
+		code response.StatusCode
+		out  string
+	}{
+		{"unavailable", func(c *Config) {}, down, response.ExOK, msg},
+		{"unavailable -x", noFallback, down, response.ExUnAvailable, ""},
+		{"unavailable -x -X", func(c *Config) { c.DisableSafeFb, c.UnavailableTempfail = true, true }, down, response.ExTempFail, ""},
+		{"protocol", func(c *Config) {}, garbled, response.ExOK, msg},
+		{"protocol -x", noFallback, garbled, response.ExProtocol, ""},
+		{"construction", badTimeout, down, response.ExOK, msg},
+		{"construction -x", func(c *Config) { noFallback(c); badTimeout(c) }, down, response.ExSoftware, ""},
+	}
+	for _, tt := range tests {
+		withConfig(tt.set, func(buf *bytes.Buffer) {
+			c, err := newClient([]spamdclient.Endpoint{tt.ep})
+			if err == nil {
+				o := &spamdclient.RequestOptions{RawBody: spamdclient.Bool(true)}
+				_, err = process(ctx, c, strings.NewReader(msg), o, nil)
+			}
+			if err == nil {
+				t.Fatalf("%s: an error should be returned", tt.name)
+			}
+			if code := failed([]byte(msg), err); code != tt.code {
+				t.Errorf("%s: got %s want %s", tt.name, code.String(), tt.code.String())
+			}
+			if buf.String() != tt.out {
+				t.Errorf("%s: got %q want %q", tt.name, buf.String(), tt.out)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// readMessage reads the message from r, big is true when it is
+// larger than max in which case only the first max+1 bytes are read
+func readMessage(r io.Reader, max int64) (b []byte, big bool, err error) {
+	if b, err = ioutil.ReadAll(io.LimitReader(r, max+1)); err != nil {
+		return
+	}
+	big = int64(len(b)) > max
+	return
+}
+
+// bodyOf returns the body of the message b, the part following
+// the blank line ending the headers
+func bodyOf(b []byte) []byte {
+	for i := 0; i < len(b); {
+		j := bytes.IndexByte(b[i:], '\n')
+		if j == -1 {
+			break
+		}
+		line := b[i : i+j]
+		i += j + 1
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return b[i:]
+		}
+	}
+	return nil
+}
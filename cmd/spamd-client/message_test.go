@@ -0,0 +1,55 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	msg := "Subject: test\r\n\r\nbody\r\n"
+	tests := []struct {
+		max  int64
+		big  bool
+		read int
+	}{
+		{int64(len(msg)), false, len(msg)},
+		{int64(len(msg)) + 10, false, len(msg)},
+		{int64(len(msg)) - 1, true, len(msg)},
+		{5, true, 6},
+	}
+	for _, tt := range tests {
+		b, big, e := readMessage(strings.NewReader(msg), tt.max)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if big != tt.big {
+			t.Errorf("max %d: got %t want %t", tt.max, big, tt.big)
+		}
+		if len(b) != tt.read {
+			t.Errorf("max %d: got %d bytes want %d", tt.max, len(b), tt.read)
+		}
+	}
+}
+
+func TestBodyOf(t *testing.T) {
+	tests := []struct {
+		in   string
+		body string
+	}{
+		{"Subject: test\r\n\r\nbody\r\n", "body\r\n"},
+		{"Subject: test\n\nbody\nmore", "body\nmore"},
+		{"Subject: test\r\n\r\n", ""},
+		{"\r\nbody", "body"},
+		{"Subject: test\r\n", ""},
+	}
+	for _, tt := range tests {
+		if b := string(bodyOf([]byte(tt.in))); b != tt.body {
+			t.Errorf("%q: got %q want %q", tt.in, b, tt.body)
+		}
+	}
+}
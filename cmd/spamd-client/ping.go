@@ -0,0 +1,59 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+// ping sends a PING to every endpoint and prints the status and
+// round trip time of each, EX_OK is returned when all of them
+// answered otherwise the code of the first failure
+func ping(ctx context.Context, endpoints []spamdclient.Endpoint) (code response.StatusCode) {
+	var err error
+
+	if len(endpoints) == 0 {
+		if endpoints, err = resolveDests(ctx); err != nil {
+			code = errCode(err)
+			fmt.Fprintf(out, "%s %s %s\n", strings.Join(cfg.Dest, ","), code.String(), err)
+			return
+		}
+	}
+	for _, ep := range endpoints {
+		c := pingEndpoint(ctx, ep)
+		if code == response.ExOK {
+			code = c
+		}
+	}
+	return
+}
+
+func pingEndpoint(ctx context.Context, ep spamdclient.Endpoint) (code response.StatusCode) {
+	var ok bool
+	var err error
+	var c *spamdclient.Client
+
+	opts := append(clientOptions(), spamdclient.WithEndpoints(ep))
+	if c, err = spamdclient.NewClientWithOptions(opts...); err == nil {
+		start := time.Now()
+		if ok, err = c.Ping(ctx); err == nil && ok {
+			fmt.Fprintf(out, "%s %s PONG %s\n", ep.Address, response.ExOK.String(), time.Since(start).Round(time.Microsecond))
+			return
+		}
+	}
+	if err == nil {
+		err = &spamdclient.ServerError{Code: response.ExProtocol}
+	}
+	code = errCode(err)
+	fmt.Fprintf(out, "%s %s %s\n", ep.Address, code.String(), err)
+	return
+}
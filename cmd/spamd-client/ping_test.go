@@ -0,0 +1,54 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+	"github.com/baruwa-enterprise/spamd-client/pkg/spamdtest"
+)
+
+func TestPing(t *testing.T) {
+	var buf bytes.Buffer
+
+	s := spamdtest.NewServer(spamdtest.Canned(&spamdtest.Result{}))
+	defer s.Close()
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	defer func(w io.Writer) { out = w }(out)
+	out = &buf
+
+	up := s.Endpoint()
+	down := spamdclient.Endpoint{Network: "tcp", Address: closed}
+	if code := ping(context.Background(), []spamdclient.Endpoint{up, up}); code != response.ExOK {
+		t.Errorf("Got %d want %d", code, response.ExOK)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], up.Address+" EX_OK PONG ") {
+		t.Errorf("Got %q want a PONG line for each endpoint", buf.String())
+	}
+
+	buf.Reset()
+	if code := ping(context.Background(), []spamdclient.Endpoint{up, down}); code != response.ExUnAvailable {
+		t.Errorf("Got %d want %d", code, response.ExUnAvailable)
+	}
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], down.Address+" EX_UNAVAILABLE ") {
+		t.Errorf("Got %q want the failure of %s", buf.String(), down.Address)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+	flag "github.com/spf13/pflag"
+)
+
+// splitPipeArgs splits args at the --pipe-to command, the arguments
+// following the command are its own and are not parsed as options
+func splitPipeArgs(fs *flag.FlagSet, args []string) (opts, cmdArgs []string) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--":
+			return args, nil
+		case a == "--pipe-to":
+			if i+1 < len(args) {
+				return args[:i+2], args[i+2:]
+			}
+			return args, nil
+		case strings.HasPrefix(a, "--pipe-to="):
+			return args[:i+1], args[i+1:]
+		case strings.HasPrefix(a, "--"):
+			if f := fs.Lookup(strings.TrimPrefix(a, "--")); takesValue(f) {
+				i++
+			}
+		case strings.HasPrefix(a, "-") && len(a) > 1:
+			// shorthands may be grouped, the value of the first
+			// one taking a value is the rest of the group or the
+			// next argument
+			for j := 1; j < len(a); j++ {
+				f := fs.ShorthandLookup(a[j : j+1])
+				if !takesValue(f) {
+					continue
+				}
+				if j+1 == len(a) {
+					i++
+				}
+				if f.Name == "pipe-to" {
+					if i+1 < len(args) {
+						return args[:i+1], args[i+1:]
+					}
+					return args, nil
+				}
+				break
+			}
+		}
+	}
+	return args, nil
+}
+
+// takesValue returns true when f requires a value
+func takesValue(f *flag.Flag) bool {
+	return f != nil && f.NoOptDefVal == ""
+}
+
+// pipeTo runs the --pipe-to command with args writing r to its
+// stdin, its exit status is returned
+func pipeTo(r io.Reader, name string, args []string) (code response.StatusCode) {
+	var ee *exec.ExitError
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = r
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	switch {
+	case err == nil:
+	case errors.As(err, &ee):
+		if code = response.StatusCode(ee.ExitCode()); code < 0 {
+			// killed by a signal
+			code = response.ExSoftware
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmdName, err)
+		code = response.ExOSErr
+	}
+	return
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+	flag "github.com/spf13/pflag"
+)
+
+func TestSplitPipeArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		opts string
+		args string
+	}{
+		{"-c -d localhost", "-c -d localhost", ""},
+		{"-x -e /usr/bin/procmail -f -a x", "-x -e /usr/bin/procmail", "-f -a x"},
+		{"-xe procmail -f", "-xe procmail", "-f"},
+		{"-eprocmail -f", "-eprocmail", "-f"},
+		{"--pipe-to procmail -d x", "--pipe-to procmail", "-d x"},
+		{"--pipe-to=procmail -d x", "--pipe-to=procmail", "-d x"},
+		{"-d -e -e procmail -f", "-d -e -e procmail", "-f"},
+		{"--dest -e -e procmail -f", "--dest -e -e procmail", "-f"},
+		{"-S -e procmail -f", "-S -e procmail", "-f"},
+		{"-- -e procmail", "-- -e procmail", ""},
+		{"-e", "-e", ""},
+	}
+	for _, tt := range tests {
+		opts, args := splitPipeArgs(flag.CommandLine, strings.Fields(tt.in))
+		if !reflect.DeepEqual(opts, strings.Fields(tt.opts)) {
+			t.Errorf("%q: got %q want %q", tt.in, opts, tt.opts)
+		}
+		if !reflect.DeepEqual(args, strings.Fields(tt.args)) && len(args)+len(tt.args) > 0 {
+			t.Errorf("%q: got %q want %q", tt.in, args, tt.args)
+		}
+	}
+}
+
+func TestPipeTo(t *testing.T) {
+	if code := pipeTo(strings.NewReader("test"), "sh", []string{"-c", "test \"$(cat)\" = test"}); code != response.ExOK {
+		t.Errorf("Got %d want %d", code, response.ExOK)
+	}
+	if code := pipeTo(strings.NewReader("test"), "sh", []string{"-c", "exit 75"}); code != response.ExTempFail {
+		t.Errorf("Got %d want %d", code, response.ExTempFail)
+	}
+	if code := pipeTo(strings.NewReader("test"), "/nonexistent/command", nil); code != response.ExOSErr {
+		t.Errorf("Got %d want %d", code, response.ExOSErr)
+	}
+}
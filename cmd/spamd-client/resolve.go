@@ -0,0 +1,103 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+)
+
+const (
+	noAddrErr = "no suitable address found"
+)
+
+// lookupFunc resolves a host name to its addresses
+type lookupFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// resolve returns an endpoint for every address of the dests, only
+// IPv4 or IPv6 addresses are kept when network is tcp4 or tcp6 and
+// the addresses are shuffled when randomize is set. The hosts that
+// fail to resolve are skipped, an error is returned when no address
+// remains.
+func resolve(ctx context.Context, lookup lookupFunc, dests []string, port int, network string, randomize bool) (endpoints []spamdclient.Endpoint, err error) {
+	var addrs []net.IPAddr
+	var lookupErr error
+
+	seen := make(map[string]bool)
+	for _, d := range dests {
+		var ips []net.IPAddr
+
+		host := strings.Trim(d, "[]")
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IPAddr{{IP: ip}}
+		} else if ips, lookupErr = lookup(ctx, host); lookupErr != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if !usable(ip.IP, network) || seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			addrs = append(addrs, ip)
+		}
+	}
+	if len(addrs) == 0 {
+		if err = lookupErr; err == nil {
+			err = &net.DNSError{Err: noAddrErr, Name: strings.Join(dests, ","), IsNotFound: true}
+		}
+		return
+	}
+
+	if randomize {
+		rand.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+	}
+	for _, a := range addrs {
+		endpoints = append(endpoints, spamdclient.Endpoint{
+			Network: network,
+			Address: net.JoinHostPort(a.String(), strconv.Itoa(port)),
+		})
+	}
+	return
+}
+
+// usable returns true when ip can be used on network
+func usable(ip net.IP, network string) bool {
+	switch network {
+	case "tcp4":
+		return ip.To4() != nil
+	case "tcp6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// resolveDests resolves the --dest hosts, every address of the
+// hosts is tried in turn
+func resolveDests(ctx context.Context) (endpoints []spamdclient.Endpoint, err error) {
+	network := "tcp"
+	if cfg.UseIPv4 {
+		network = "tcp4"
+	}
+	if cfg.UseIPv6 {
+		network = "tcp6"
+	}
+	if cfg.ConnTimeOut > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.ConnTimeOut)*time.Second)
+		defer cancel()
+	}
+
+	endpoints, err = resolve(ctx, net.DefaultResolver.LookupIPAddr, cfg.Dest, cfg.Port, network, cfg.Randomize)
+	return
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+func testLookup(ctx context.Context, host string) (addrs []net.IPAddr, err error) {
+	hosts := map[string][]string{
+		"spamd1.example.com": {"192.0.2.1", "2001:db8::1", "192.0.2.2"},
+		"spamd2.example.com": {"192.0.2.2", "192.0.2.3"},
+		"v6.example.com":     {"2001:db8::2"},
+	}
+	ips, ok := hosts[host]
+	if !ok {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		return
+	}
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return
+}
+
+func addresses(endpoints []spamdclient.Endpoint) (addrs []string) {
+	for _, ep := range endpoints {
+		addrs = append(addrs, ep.Address)
+	}
+	return
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		dests   []string
+		network string
+		want    []string
+	}{
+		{
+			[]string{"spamd1.example.com", "spamd2.example.com"}, "tcp",
+			[]string{"192.0.2.1:783", "[2001:db8::1]:783", "192.0.2.2:783", "192.0.2.3:783"},
+		},
+		{
+			[]string{"spamd1.example.com", "127.0.0.1", "::1"}, "tcp4",
+			[]string{"192.0.2.1:783", "192.0.2.2:783", "127.0.0.1:783"},
+		},
+		{
+			[]string{"spamd1.example.com", "[::1]", "127.0.0.1"}, "tcp6",
+			[]string{"[2001:db8::1]:783", "[::1]:783"},
+		},
+	}
+	for _, tt := range tests {
+		endpoints, e := resolve(ctx, testLookup, tt.dests, 783, tt.network, false)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if got := addresses(endpoints); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v %s: got %v want %v", tt.dests, tt.network, got, tt.want)
+		}
+		for _, ep := range endpoints {
+			if ep.Network != tt.network {
+				t.Errorf("Got %s want %s", ep.Network, tt.network)
+			}
+		}
+	}
+}
+
+func TestResolveRandomize(t *testing.T) {
+	dests := []string{"spamd1.example.com", "spamd2.example.com"}
+	want, _ := resolve(context.Background(), testLookup, dests, 783, "tcp", false)
+	shuffled := false
+	for i := 0; i < 20 && !shuffled; i++ {
+		endpoints, e := resolve(context.Background(), testLookup, dests, 783, "tcp", true)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		shuffled = !reflect.DeepEqual(endpoints, want)
+		got, w := addresses(endpoints), addresses(want)
+		sort.Strings(got)
+		sort.Strings(w)
+		if !reflect.DeepEqual(got, w) {
+			t.Fatalf("Got %v want %v", got, w)
+		}
+	}
+	if !shuffled {
+		t.Errorf("The addresses should be shuffled")
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	var de *net.DNSError
+	_, e := resolve(context.Background(), testLookup, []string{"missing.example.com"}, 783, "tcp", false)
+	if !errors.As(e, &de) {
+		t.Errorf("Got %v want a DNSError", e)
+	}
+	endpoints, e := resolve(context.Background(), testLookup, []string{"missing.example.com", "spamd2.example.com"}, 783, "tcp", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if got, want := addresses(endpoints), []string{"192.0.2.2:783", "192.0.2.3:783"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v want %v", got, want)
+	}
+	_, e = resolve(context.Background(), testLookup, []string{"v6.example.com"}, 783, "tcp4", false)
+	if !errors.As(e, &de) || de.Err != noAddrErr {
+		t.Errorf("Got %v want %s", e, noAddrErr)
+	}
+	if code := errCode(e); code != response.ExNoHost {
+		t.Errorf("Got %d want %d", code, response.ExNoHost)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package main
+spamd-proxy - spamd protocol proxy
+*/
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+	"github.com/baruwa-enterprise/spamd-client/pkg/server"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	shutdownTimeout = 30 * time.Second
+	clientCAErr     = "No certificates found in %s"
+)
+
+var (
+	cfg     *Config
+	cmdName string
+)
+
+// Config represents the configuration flags
+type Config struct {
+	Listen            string
+	UnixSocket        string
+	Backends          []string
+	Routes            []string
+	DefaultGroup      string
+	MaxPerClient      int
+	MaxSize           int64
+	TimeOut           int
+	ConnTimeOut       int
+	ReadTimeOut       int
+	UseCompression    bool
+	TLSCert           string
+	TLSKey            string
+	TLSClientCA       string
+	BackendTLS        string
+	BackendTLSCert    string
+	BackendTLSKey     string
+	BackendTLSCAFile  string
+	BackendServerName string
+	LogFile           string
+	Version           bool
+}
+
+func init() {
+	cmdName = path.Base(os.Args[0])
+	cfg = &Config{}
+	flag.StringVarP(&cfg.Listen, "listen", "l", "127.0.0.1:783",
+		`Address to accept spamd connections on.`)
+	flag.StringVarP(&cfg.UnixSocket, "socket", "U", "",
+		`Accept spamd connections on this UNIX domain
+socket instead.`)
+	flag.StringArrayVarP(&cfg.Backends, "backend", "b", nil,
+		`Backend spamd server as [group=]address, the
+address is host[:port] or a socket path. Give
+more than once to add servers or groups.`)
+	flag.StringArrayVarP(&cfg.Routes, "route", "r", nil,
+		`Send requests for a user to a backend group
+as user=group. Give more than once.`)
+	flag.StringVar(&cfg.DefaultGroup, "default-group", defaultGroup,
+		`Backend group used for unrouted users.`)
+	flag.IntVar(&cfg.MaxPerClient, "max-per-client", 0,
+		`Maximum concurrent requests from a client
+address, 0 for no limit.`)
+	flag.Int64VarP(&cfg.MaxSize, "max-size", "s", 500000,
+		`Maximum message size, in bytes.`)
+	flag.IntVarP(&cfg.TimeOut, "timeout", "t", 600,
+		`Timeout in seconds for communications to the
+backends.`)
+	flag.IntVarP(&cfg.ConnTimeOut, "connect-timeout", "n", 30,
+		`Timeout in seconds when connecting to a backend.`)
+	flag.IntVar(&cfg.ReadTimeOut, "read-timeout", 60,
+		`Timeout in seconds for reading a request.`)
+	flag.BoolVarP(&cfg.UseCompression, "use-compression", "z", false,
+		`Compress messages sent to the backends.`)
+	flag.StringVar(&cfg.TLSCert, "ssl-cert", "",
+		`Certificate used to accept TLS connections.`)
+	flag.StringVar(&cfg.TLSKey, "ssl-key", "",
+		`Private key of the TLS certificate.`)
+	flag.StringVar(&cfg.TLSClientCA, "ssl-client-ca", "",
+		`Require clients to present a certificate
+signed by these CA certificates.`)
+	flag.StringVar(&cfg.BackendTLS, "backend-ssl", "",
+		`Use SSL to talk to the backends, optionally
+giving the minimum version.`)
+	flag.Lookup("backend-ssl").NoOptDefVal = "tlsv1.2"
+	flag.StringVar(&cfg.BackendTLSCert, "backend-ssl-cert", "",
+		`Client certificate to present to the backends.`)
+	flag.StringVar(&cfg.BackendTLSKey, "backend-ssl-key", "",
+		`Private key of the backend client certificate.`)
+	flag.StringVar(&cfg.BackendTLSCAFile, "backend-ssl-ca-file", "",
+		`CA certificates used to verify the backends.`)
+	flag.StringVar(&cfg.BackendServerName, "backend-server-name", "",
+		`Name used to verify the backend certificates.`)
+	flag.StringVarP(&cfg.LogFile, "log-file", "o", "",
+		`Append the JSON request log to this file
+instead of stdout.`)
+	flag.BoolVarP(&cfg.Version, "version", "V", false,
+		`Print spamd-proxy version and exit.`)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "spamd proxy version %s\n\n", Version)
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] --backend address\n", cmdName)
+	fmt.Fprint(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var err error
+	var l net.Listener
+	var p *proxy
+
+	flag.Usage = usage
+	flag.ErrHelp = errors.New("")
+	flag.CommandLine.SortFlags = false
+	flag.Parse()
+	if cfg.Version {
+		fmt.Fprintf(os.Stdout, "spamd proxy version %s SPAMD/%s\n", Version, server.Version)
+		os.Exit(0)
+	}
+	if len(cfg.Backends) == 0 {
+		usageErr("%s: Please specify at least one --backend")
+	}
+
+	if p, err = newProxy(); err != nil {
+		usageErr("%s: " + err.Error())
+	}
+
+	s := &server.Server{
+		Handler:     p,
+		ReadTimeout: time.Duration(cfg.ReadTimeOut) * time.Second,
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		if s.TLSConfig, err = serverTLS(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.UnixSocket != "" {
+		os.Remove(cfg.UnixSocket)
+		l, err = net.Listen("unix", cfg.UnixSocket)
+	} else {
+		l, err = net.Listen("tcp", cfg.Listen)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if e := s.Shutdown(ctx); e != nil {
+			s.Close()
+		}
+	}()
+
+	if err = s.Serve(l); err != nil && err != server.ErrServerClosed {
+		log.Fatal(err)
+	}
+	for _, c := range p.groups {
+		c.Close()
+	}
+}
+
+func usageErr(s string) {
+	fmt.Fprintf(os.Stderr, s+"\n", cmdName)
+	flag.PrintDefaults()
+	os.Exit(int(response.ExUsage))
+}
+
+// newProxy returns a proxy with a client for each backend group
+func newProxy() (p *proxy, err error) {
+	var group, user string
+	var ep spamdclient.Endpoint
+	var w io.Writer = os.Stdout
+
+	endpoints := make(map[string][]spamdclient.Endpoint)
+	for _, b := range cfg.Backends {
+		if group, ep, err = parseBackend(b); err != nil {
+			return
+		}
+		endpoints[group] = append(endpoints[group], ep)
+	}
+
+	p = &proxy{
+		groups:       make(map[string]*spamdclient.Client),
+		routes:       make(map[string]string),
+		defaultGroup: cfg.DefaultGroup,
+		maxPerClient: cfg.MaxPerClient,
+		maxSize:      cfg.MaxSize,
+		timeout:      time.Duration(cfg.TimeOut) * time.Second,
+		compress:     cfg.UseCompression,
+		active:       make(map[string]int),
+	}
+	for _, r := range cfg.Routes {
+		if user, group, err = parseRoute(r); err != nil {
+			return
+		}
+		p.routes[user] = group
+	}
+
+	opts := []spamdclient.Option{
+		spamdclient.WithConnTimeout(time.Duration(cfg.ConnTimeOut) * time.Second),
+		spamdclient.WithLogger(spamdclient.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), spamdclient.LevelWarn)),
+	}
+	if cfg.UseCompression {
+		opts = append(opts, spamdclient.WithCompression())
+	}
+	if flag.CommandLine.Changed("backend-ssl") {
+		var o []spamdclient.Option
+		if o, err = backendTLS(); err != nil {
+			return
+		}
+		opts = append(opts, o...)
+	}
+	for g, eps := range endpoints {
+		if p.groups[g], err = spamdclient.NewClientWithOptions(
+			append([]spamdclient.Option{spamdclient.WithEndpoints(eps...)}, opts...)...); err != nil {
+			return
+		}
+	}
+	if err = p.checkRoutes(); err != nil {
+		return
+	}
+
+	if cfg.LogFile != "" {
+		if w, err = os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640); err != nil {
+			return
+		}
+	}
+	p.log = w
+	return
+}
+
+// backendTLS returns the client options used to talk TLS
+// to the backends
+func backendTLS() (opts []spamdclient.Option, err error) {
+	var v uint16
+	if v, err = spamdclient.ParseTLSVersion(cfg.BackendTLS); err != nil {
+		return
+	}
+	opts = append(opts, spamdclient.WithTLS(), spamdclient.WithTLSVersion(v, 0))
+	if cfg.BackendTLSCAFile != "" {
+		opts = append(opts, spamdclient.WithRootCA(cfg.BackendTLSCAFile))
+	}
+	if cfg.BackendTLSCert != "" || cfg.BackendTLSKey != "" {
+		opts = append(opts, spamdclient.WithClientCert(cfg.BackendTLSCert, cfg.BackendTLSKey))
+	}
+	if cfg.BackendServerName != "" {
+		opts = append(opts, spamdclient.WithServerName(cfg.BackendServerName))
+	}
+	return
+}
+
+// serverTLS returns the TLS configuration used to accept
+// client connections
+func serverTLS() (conf *tls.Config, err error) {
+	var b []byte
+	var cert tls.Certificate
+
+	if cert, err = tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+		return
+	}
+	conf = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.TLSClientCA == "" {
+		return
+	}
+	if b, err = ioutil.ReadFile(cfg.TLSClientCA); err != nil {
+		return
+	}
+	conf.ClientCAs = x509.NewCertPool()
+	if !conf.ClientCAs.AppendCertsFromPEM(b) {
+		err = fmt.Errorf(clientCAErr, cfg.TLSClientCA)
+		return
+	}
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	return
+}
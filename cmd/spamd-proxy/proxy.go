@@ -0,0 +1,293 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/header"
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+	"github.com/baruwa-enterprise/spamd-client/pkg/server"
+)
+
+const (
+	defaultGroup   = "default"
+	defaultPort    = "783"
+	backendSpecErr = "Invalid backend %q, expected [group=]address"
+	routeSpecErr   = "Invalid route %q, expected user=group"
+	noGroupErr     = "Route %q uses unknown backend group %q"
+	tooManyErr     = "too many concurrent requests from %s"
+	tooLargeErr    = "message larger than %d bytes"
+)
+
+// A proxy relays spamd requests to groups of backend servers,
+// the group is chosen by the User header of the request
+type proxy struct {
+	groups       map[string]*spamdclient.Client
+	routes       map[string]string
+	defaultGroup string
+	maxPerClient int
+	maxSize      int64
+	timeout      time.Duration
+	compress     bool
+	log          io.Writer
+
+	mu     sync.Mutex
+	active map[string]int
+	logMu  sync.Mutex
+}
+
+// logEntry is the JSON line logged for each request
+type logEntry struct {
+	Time     string  `json:"time"`
+	Remote   string  `json:"remote"`
+	Method   string  `json:"method"`
+	User     string  `json:"user"`
+	Group    string  `json:"group,omitempty"`
+	Backend  string  `json:"backend,omitempty"`
+	Code     string  `json:"code"`
+	IsSpam   bool    `json:"is_spam"`
+	Score    float64 `json:"score"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// parseBackend parses a [group=]address backend, address is
+// a unix socket path or host[:port]
+func parseBackend(s string) (group string, ep spamdclient.Endpoint, err error) {
+	group = defaultGroup
+	addr := s
+	if i := strings.Index(s, "="); i >= 0 {
+		group, addr = s[:i], s[i+1:]
+	}
+	if group == "" || addr == "" {
+		err = fmt.Errorf(backendSpecErr, s)
+		return
+	}
+	if strings.HasPrefix(addr, "/") {
+		ep = spamdclient.Endpoint{Network: "unix", Address: addr}
+		return
+	}
+	if _, _, e := net.SplitHostPort(addr); e != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+	}
+	ep = spamdclient.Endpoint{Network: "tcp", Address: addr}
+	return
+}
+
+// parseRoute parses a user=group route
+func parseRoute(s string) (user, group string, err error) {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		err = fmt.Errorf(routeSpecErr, s)
+		return
+	}
+	user, group = s[:i], s[i+1:]
+	return
+}
+
+// checkRoutes ensures every route and the default group use
+// a configured backend group
+func (p *proxy) checkRoutes() (err error) {
+	for u, g := range p.routes {
+		if _, ok := p.groups[g]; !ok {
+			err = fmt.Errorf(noGroupErr, u, g)
+			return
+		}
+	}
+	if _, ok := p.groups[p.defaultGroup]; !ok {
+		err = fmt.Errorf(noGroupErr, "*", p.defaultGroup)
+	}
+	return
+}
+
+// route returns the backend group for user
+func (p *proxy) route(user string) string {
+	if g, ok := p.routes[user]; ok {
+		return g
+	}
+	return p.defaultGroup
+}
+
+// acquire reserves a request slot for host, it returns false
+// when host already has maxPerClient requests in progress
+func (p *proxy) acquire(host string) bool {
+	if p.maxPerClient <= 0 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active[host] >= p.maxPerClient {
+		return false
+	}
+	p.active[host]++
+	return true
+}
+
+func (p *proxy) release(host string) {
+	if p.maxPerClient <= 0 {
+		return
+	}
+	p.mu.Lock()
+	if p.active[host]--; p.active[host] <= 0 {
+		delete(p.active, host)
+	}
+	p.mu.Unlock()
+}
+
+// ServeSPAMD relays r to the backend group of the request user
+func (p *proxy) ServeSPAMD(w server.ResponseWriter, r *server.Request) {
+	var b []byte
+	var err error
+	var rs *response.Response
+
+	start := time.Now()
+	e := &logEntry{
+		Remote: r.RemoteAddr,
+		Method: r.Method.String(),
+		User:   r.User,
+	}
+	code := response.ExOK
+	defer func() {
+		w.WriteStatus(code)
+		e.Code = code.String()
+		if err != nil {
+			e.Error = err.Error()
+		}
+		p.logRequest(e, start)
+	}()
+
+	host := clientHost(r.RemoteAddr)
+	if !p.acquire(host) {
+		code = response.ExTempFail
+		err = fmt.Errorf(tooManyErr, host)
+		return
+	}
+	defer p.release(host)
+
+	if r.Method == request.Skip {
+		return
+	}
+
+	e.Group = p.route(r.User)
+	c := p.groups[e.Group]
+
+	var body io.Reader
+	if r.Method != request.Ping {
+		if b, err = ioutil.ReadAll(io.LimitReader(r.Body, p.maxSize+1)); err != nil {
+			code = response.ExIOErr
+			return
+		}
+		if int64(len(b)) > p.maxSize {
+			code = response.ExDataErr
+			err = fmt.Errorf(tooLargeErr, p.maxSize)
+			return
+		}
+		body = bytes.NewReader(b)
+	}
+
+	o := &spamdclient.RequestOptions{
+		User:    r.User,
+		RawBody: spamdclient.Bool(true),
+		// the body is forwarded as the client sent it
+		Verbatim: true,
+		Timeout:  p.timeout,
+		Action:   r.Action,
+		MsgType:  r.MsgType,
+	}
+	// FORGET requests carry no Message-class
+	if r.Method == request.Tell && o.MsgType == request.NoneType {
+		o.MsgType = request.Spam
+	}
+
+	rs, err = c.Do(r.Context(), r.Method, body, o)
+	if rs != nil {
+		e.Backend = rs.Endpoint
+	}
+	if err != nil {
+		code = statusFor(err)
+		return
+	}
+
+	e.IsSpam, e.Score = rs.IsSpam, rs.Score
+	copyHeaders(w.Header(), rs.Headers)
+	w.Write(rs.Raw)
+}
+
+// copyHeaders copies the backend response headers, the
+// Content-length is set by the server
+func copyHeaders(dst, src textproto.MIMEHeader) {
+	cl := textproto.CanonicalMIMEHeaderKey(header.ContentLength.String())
+	for k, vs := range src {
+		if k == cl {
+			continue
+		}
+		for _, v := range vs {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// statusFor returns the status sent to the client when the
+// backend request fails with err
+func statusFor(err error) (code response.StatusCode) {
+	var se *spamdclient.ServerError
+	var de *spamdclient.DialError
+
+	switch {
+	case errors.As(err, &se):
+		code = se.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		code = response.ExTimeout
+	case errors.As(err, &de):
+		code = response.ExUnAvailable
+	case spamdclient.IsRetryable(err):
+		code = response.ExTempFail
+	default:
+		code = response.ExSoftware
+	}
+	return
+}
+
+// clientHost returns the host part of a remote address, the
+// limits of unix socket clients are shared
+func clientHost(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
+
+func (p *proxy) logRequest(e *logEntry, start time.Time) {
+	if p.log == nil {
+		return
+	}
+	e.Time = start.UTC().Format(time.RFC3339Nano)
+	e.Duration = time.Since(start).Seconds()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	p.logMu.Lock()
+	p.log.Write(b)
+	p.logMu.Unlock()
+}
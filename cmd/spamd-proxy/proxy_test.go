@@ -0,0 +1,278 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+	"github.com/baruwa-enterprise/spamd-client/pkg/server"
+	"github.com/baruwa-enterprise/spamd-client/pkg/spamdtest"
+)
+
+const testMsg = "From: sender@example.com\r\nSubject: test\r\n\r\nbody\r\n"
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) entries(t *testing.T) (e []logEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimSpace(s.b.String()), "\n") {
+		var l logEntry
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		e = append(e, l)
+	}
+	return
+}
+
+func newBackend(t *testing.T, score float64) *spamdtest.Server {
+	b := spamdtest.NewServer(spamdtest.Canned(&spamdtest.Result{
+		IsSpam: score >= 5,
+		Score:  score,
+		Rules:  response.Rules{{Name: "BAYES_99", Score: 3.5, HasScore: true}},
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func newGroup(t *testing.T, b *spamdtest.Server) *spamdclient.Client {
+	c, e := spamdclient.NewClientWithOptions(spamdclient.WithEndpoints(b.Endpoint()))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	return c
+}
+
+// startProxy serves p and returns a client connected to it
+func startProxy(t *testing.T, p *proxy) *spamdclient.Client {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	s := &server.Server{Handler: p, ErrorLog: log.New(ioutil.Discard, "", 0)}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	c, e := spamdclient.NewClientWithOptions(spamdclient.WithEndpoint("tcp", l.Addr().String()))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	return c
+}
+
+func newTestProxy(t *testing.T, w *syncBuffer) (p *proxy, ham, spam *spamdtest.Server) {
+	ham = newBackend(t, 0.5)
+	spam = newBackend(t, 9.5)
+	p = &proxy{
+		groups: map[string]*spamdclient.Client{
+			defaultGroup: newGroup(t, ham),
+			"strict":     newGroup(t, spam),
+		},
+		routes:       map[string]string{"alice": "strict"},
+		defaultGroup: defaultGroup,
+		maxSize:      1024,
+		log:          w,
+		active:       make(map[string]int),
+	}
+	return
+}
+
+func TestProxyRouting(t *testing.T) {
+	ctx := context.Background()
+	w := &syncBuffer{}
+	p, ham, spam := newTestProxy(t, w)
+	c := startProxy(t, p)
+
+	if ok, e := c.Ping(ctx); e != nil || !ok {
+		t.Fatalf("Unexpected error: %v %t", e, ok)
+	}
+
+	o := &spamdclient.RequestOptions{User: "alice"}
+	rs, e := c.Do(ctx, request.Check, strings.NewReader(testMsg), o)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if !rs.IsSpam || rs.Score != 9.5 {
+		t.Errorf("Got %t %v want the strict group result", rs.IsSpam, rs.Score)
+	}
+	if rq := spam.LastRequest(); rq == nil || rq.User != "alice" || string(rq.Body) != testMsg+"\r\n" {
+		t.Errorf("Got %+v want the relayed request", rq)
+	}
+
+	o.User = "bob"
+	rs, e = c.Do(ctx, request.Symbols, strings.NewReader(testMsg), o)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if rs.IsSpam || len(rs.Rules) != 1 || rs.Rules[0].Name != "BAYES_99" {
+		t.Errorf("Got %t %v want the default group result", rs.IsSpam, rs.Rules)
+	}
+
+	rs, e = c.Process(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if rs.Msg.Header.Get("X-Spam-Flag") != "NO" || !bytes.Contains(rs.Msg.Body, []byte("body")) {
+		t.Errorf("Got %v %q want the processed message", rs.Msg.Header, rs.Msg.Body)
+	}
+
+	rs, e = c.Learn(ctx, strings.NewReader(testMsg), request.Ham)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if rs.Headers.Get("DidSet") != "local" {
+		t.Errorf("Got %v want DidSet", rs.Headers)
+	}
+	if rq := ham.LastRequest(); rq.Action != request.LearnAction || rq.MsgType != request.Ham {
+		t.Errorf("Got %v %v want a learn ham request", rq.Action, rq.MsgType)
+	}
+
+	entries := w.entries(t)
+	if len(entries) != 5 {
+		t.Fatalf("Got %d want %d log lines", len(entries), 5)
+	}
+	e1 := entries[1]
+	if e1.Method != "CHECK" || e1.User != "alice" || e1.Group != "strict" || e1.Score != 9.5 ||
+		e1.Backend != spam.Endpoint().Address || e1.Code != "EX_OK" || e1.Duration <= 0 {
+		t.Errorf("Got %+v want the CHECK log line", e1)
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	ctx := context.Background()
+	w := &syncBuffer{}
+	p, _, _ := newTestProxy(t, w)
+	c := startProxy(t, p)
+
+	_, e := c.Check(ctx, strings.NewReader(strings.Repeat("x", 2048)))
+	if !errors.Is(e, response.ExDataErr) {
+		t.Errorf("Got %v want %s", e, response.ExDataErr)
+	}
+
+	denied := spamdtest.NewServer(spamdtest.Canned(&spamdtest.Result{Code: response.ExNoPerm}))
+	defer denied.Close()
+	p.groups["denied"] = newGroup(t, denied)
+	p.routes["mallory"] = "denied"
+	_, e = c.Do(ctx, request.Check, strings.NewReader(testMsg), &spamdclient.RequestOptions{User: "mallory"})
+	if !errors.Is(e, response.ExNoPerm) {
+		t.Errorf("Got %v want %s", e, response.ExNoPerm)
+	}
+
+	entries := w.entries(t)
+	if len(entries) != 2 || entries[0].Error == "" || entries[1].Code != "EX_NOPERM" {
+		t.Errorf("Got %+v want the error log lines", entries)
+	}
+}
+
+func TestProxyLimit(t *testing.T) {
+	ctx := context.Background()
+	p, _, _ := newTestProxy(t, &syncBuffer{})
+	p.maxPerClient = 1
+	c := startProxy(t, p)
+
+	if !p.acquire("127.0.0.1") {
+		t.Fatalf("The first slot should be acquired")
+	}
+	_, e := c.Check(ctx, strings.NewReader(testMsg))
+	if !errors.Is(e, response.ExTempFail) {
+		t.Errorf("Got %v want %s", e, response.ExTempFail)
+	}
+	p.release("127.0.0.1")
+	if _, e = c.Check(ctx, strings.NewReader(testMsg)); e != nil {
+		t.Errorf("Unexpected error: %s", e)
+	}
+	if len(p.active) != 0 {
+		t.Errorf("Got %v want no active requests", p.active)
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	tests := []struct {
+		in    string
+		group string
+		ep    spamdclient.Endpoint
+	}{
+		{"127.0.0.1", defaultGroup, spamdclient.Endpoint{Network: "tcp", Address: "127.0.0.1:783"}},
+		{"strict=spamd1:7830", "strict", spamdclient.Endpoint{Network: "tcp", Address: "spamd1:7830"}},
+		{"v6=[::1]", "v6", spamdclient.Endpoint{Network: "tcp", Address: "[::1]:783"}},
+		{"local=/var/run/spamd.sock", "local", spamdclient.Endpoint{Network: "unix", Address: "/var/run/spamd.sock"}},
+	}
+	for _, tt := range tests {
+		g, ep, e := parseBackend(tt.in)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if g != tt.group || ep != tt.ep {
+			t.Errorf("%s: got %s %v want %s %v", tt.in, g, ep, tt.group, tt.ep)
+		}
+	}
+	for _, in := range []string{"", "=host", "group="} {
+		if _, _, e := parseBackend(in); e == nil {
+			t.Errorf("%q: an error should be returned", in)
+		}
+	}
+	for _, in := range []string{"alice", "=strict", "alice="} {
+		if _, _, e := parseRoute(in); e == nil {
+			t.Errorf("%q: an error should be returned", in)
+		}
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	p := &proxy{
+		groups:       map[string]*spamdclient.Client{defaultGroup: nil},
+		routes:       map[string]string{"alice": "strict"},
+		defaultGroup: defaultGroup,
+	}
+	if e := p.checkRoutes(); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	p.routes["alice"] = defaultGroup
+	p.defaultGroup = "missing"
+	if e := p.checkRoutes(); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestStatusFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		code response.StatusCode
+	}{
+		{&spamdclient.ServerError{Code: response.ExNpUser}, response.ExNpUser},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), response.ExTimeout},
+		{&spamdclient.DialError{Network: "tcp", Address: "x", Err: errors.New("refused")}, response.ExUnAvailable},
+		{spamdclient.ErrNoResponse, response.ExTempFail},
+		{errors.New("other"), response.ExSoftware},
+	}
+	for _, tt := range tests {
+		if c := statusFor(tt.err); c != tt.code {
+			t.Errorf("%v: got %s want %s", tt.err, c, tt.code)
+		}
+	}
+}
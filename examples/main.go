@@ -17,7 +17,7 @@ package main
 // IsSpam     bool
 // Headers    textproto.MIMEHeader
 // Msg        *Msg
-// Rules      []map[string]string
+// Rules      Rules
 
 import (
 	"bytes"
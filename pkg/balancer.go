@@ -0,0 +1,144 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RoundRobin selects the endpoints in turn
+	RoundRobin Balancer = iota
+	// Random selects a random endpoint
+	Random
+	// LeastInFlight selects the endpoint with the fewest
+	// requests in flight
+	LeastInFlight
+	// Ordered selects the endpoints in the order they were given,
+	// the next one is only used when the previous ones failed
+	Ordered
+)
+
+const (
+	defaultEjectCooldown = 30 * time.Second
+	noEndpointsErr       = "At least one endpoint is required"
+)
+
+// A Balancer represents an endpoint selection strategy
+type Balancer int
+
+func (b Balancer) String() (s string) {
+	n := [...]string{
+		"round-robin",
+		"random",
+		"least-in-flight",
+		"ordered",
+	}
+	if b < RoundRobin || b > Ordered {
+		return
+	}
+	s = n[b]
+	return
+}
+
+// An Endpoint represents a spamd server
+type Endpoint struct {
+	Network string
+	Address string
+}
+
+type endpoint struct {
+	Endpoint
+	pool     *pool
+	inflight int64
+	mu       sync.Mutex
+	ejected  time.Time
+}
+
+func (e *endpoint) isEjected(now time.Time) (b bool) {
+	e.mu.Lock()
+	b = now.Before(e.ejected)
+	e.mu.Unlock()
+	return
+}
+
+func (e *endpoint) eject(d time.Duration) {
+	e.mu.Lock()
+	e.ejected = time.Now().Add(d)
+	e.mu.Unlock()
+}
+
+func (e *endpoint) getPool() (p *pool) {
+	e.mu.Lock()
+	p = e.pool
+	e.mu.Unlock()
+	return
+}
+
+// setPool replaces the pool returning the previous one
+func (e *endpoint) setPool(p *pool) (old *pool) {
+	e.mu.Lock()
+	old = e.pool
+	e.pool = p
+	e.mu.Unlock()
+	return
+}
+
+func (e *endpoint) restore() {
+	e.mu.Lock()
+	e.ejected = time.Time{}
+	e.mu.Unlock()
+}
+
+// pick selects the next endpoint to use skipping the ones already
+// tried, ejected endpoints are only used when no other remain
+func (c *Client) pick(b Balancer, tried map[*endpoint]bool) (ep *endpoint) {
+	var healthy, ejected []*endpoint
+
+	now := time.Now()
+	n := len(c.endpoints)
+	start := 0
+	if b != Ordered {
+		start = int(atomic.AddUint64(&c.next, 1) % uint64(n))
+	}
+	for i := 0; i < n; i++ {
+		e := c.endpoints[(start+i)%n]
+		if tried[e] {
+			continue
+		}
+		if e.isEjected(now) {
+			ejected = append(ejected, e)
+			continue
+		}
+		healthy = append(healthy, e)
+	}
+
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	switch b {
+	case Random:
+		ep = candidates[rand.Intn(len(candidates))]
+	case LeastInFlight:
+		ep = candidates[0]
+		for _, e := range candidates[1:] {
+			if atomic.LoadInt64(&e.inflight) < atomic.LoadInt64(&ep.inflight) {
+				ep = e
+			}
+		}
+	default:
+		ep = candidates[0]
+	}
+	return
+}
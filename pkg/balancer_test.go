@@ -0,0 +1,221 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+type BalancerTestKey struct {
+	in  Balancer
+	out string
+}
+
+var TestBalancers = []BalancerTestKey{
+	{RoundRobin, "round-robin"},
+	{Random, "random"},
+	{LeastInFlight, "least-in-flight"},
+	{Ordered, "ordered"},
+	{Balancer(20), ""},
+}
+
+func TestBalancer(t *testing.T) {
+	for _, tt := range TestBalancers {
+		if s := tt.in.String(); s != tt.out {
+			t.Errorf("%q.String() = %q, want %q", tt.in, s, tt.out)
+		}
+	}
+}
+
+func closedAddr(t *testing.T) (addr string) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	addr = l.Addr().String()
+	l.Close()
+	return
+}
+
+func TestNewMultiClient(t *testing.T) {
+	_, e := NewMultiClient(nil, "exim", false)
+	if e == nil || e.Error() != noEndpointsErr {
+		t.Errorf("Got %v want %s", e, noEndpointsErr)
+	}
+	_, e = NewMultiClient([]Endpoint{
+		{Network: "tcp", Address: "127.1.1.1:4010"},
+		{Network: "udp", Address: "127.1.1.1:4010"},
+	}, "exim", false)
+	if e == nil || e.Error() != "Protocol: udp is not supported" {
+		t.Errorf("Got %v want %s", e, "Protocol: udp is not supported")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	ctx := context.Background()
+	s1 := newPingServer(t)
+	s2 := newPingServer(t)
+	c, e := NewMultiClient([]Endpoint{
+		{Network: "tcp", Address: s1.l.Addr().String()},
+		{Network: "tcp", Address: s2.l.Addr().String()},
+	}, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	for i := 0; i < 4; i++ {
+		if _, e = c.Ping(ctx); e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+	}
+	if s1.Accepted() != 2 || s2.Accepted() != 2 {
+		t.Errorf("Got %d/%d want 2/2", s1.Accepted(), s2.Accepted())
+	}
+}
+
+func TestLeastInFlight(t *testing.T) {
+	c, e := NewMultiClient([]Endpoint{
+		{Network: "tcp", Address: "127.1.1.1:4010"},
+		{Network: "tcp", Address: "127.1.1.2:4010"},
+		{Network: "tcp", Address: "127.1.1.3:4010"},
+	}, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.endpoints[0].inflight = 4
+	c.endpoints[1].inflight = 1
+	c.endpoints[2].inflight = 3
+	for i := 0; i < 3; i++ {
+		if ep := c.pick(LeastInFlight, nil); ep != c.endpoints[1] {
+			t.Errorf("Got %s want %s", ep.Address, c.endpoints[1].Address)
+		}
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	ctx := context.Background()
+	s1 := newPingServer(t)
+	s2 := newPingServer(t)
+	c, e := NewMultiClient([]Endpoint{
+		{Network: "tcp", Address: closedAddr(t)},
+		{Network: "tcp", Address: s1.l.Addr().String()},
+		{Network: "tcp", Address: s2.l.Addr().String()},
+	}, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.SetBalancer(Ordered)
+	// the failed endpoint is ejected after the first request
+	for i := 0; i < 4; i++ {
+		if _, e = c.Ping(ctx); e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+	}
+	if s1.Accepted() != 4 || s2.Accepted() != 0 {
+		t.Errorf("Got %d/%d want 4/0", s1.Accepted(), s2.Accepted())
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+	s := newPingServer(t)
+	bad := closedAddr(t)
+	c, e := NewMultiClient([]Endpoint{
+		{Network: "tcp", Address: bad},
+		{Network: "tcp", Address: s.l.Addr().String()},
+	}, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.SetEjectCooldown(time.Minute)
+	for i := 0; i < 4; i++ {
+		ok, e := c.Ping(ctx)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if !ok {
+			t.Error("Ping failed")
+		}
+	}
+	if !c.endpoints[0].isEjected(time.Now()) {
+		t.Error("The failing endpoint should be ejected")
+	}
+	if n := s.Accepted(); n != 4 {
+		t.Errorf("Got %d want %d", n, 4)
+	}
+}
+
+func TestFailoverMissingSocket(t *testing.T) {
+	ctx := context.Background()
+	s := newPingServer(t)
+	c, e := NewMultiClient([]Endpoint{
+		{Network: "unix", Address: "/tmp/.dumx.sock"},
+		{Network: "tcp", Address: s.l.Addr().String()},
+	}, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.SetEjectCooldown(time.Minute)
+	for i := 0; i < 2; i++ {
+		if ok, e := c.Ping(ctx); e != nil || !ok {
+			t.Fatalf("Got %t, %v want true, nil", ok, e)
+		}
+	}
+	if !c.endpoints[0].isEjected(time.Now()) {
+		t.Error("The missing socket should be ejected")
+	}
+}
+
+func TestFailoverTempStatus(t *testing.T) {
+	ctx := context.Background()
+	s1 := newReplyServer(t, "SPAMD/1.5 75 EX_TEMPFAIL\r\n")
+	s2 := newPingServer(t)
+	c, e := NewMultiClient([]Endpoint{
+		{Network: "tcp", Address: s1.l.Addr().String()},
+		{Network: "tcp", Address: s2.l.Addr().String()},
+	}, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	for i := 0; i < 2; i++ {
+		rs, e := c.cmd(ctx, request.Ping, request.NoAction, request.NoneType, nil, nil)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if rs.StatusCode != response.ExOK {
+			t.Errorf("Got %q want %q", rs.StatusCode, response.ExOK)
+		}
+		if rs.Endpoint != s2.l.Addr().String() {
+			t.Errorf("Got %q want %q", rs.Endpoint, s2.l.Addr().String())
+		}
+	}
+	if n := s1.Accepted(); n != 1 {
+		t.Errorf("Got %d want %d", n, 1)
+	}
+}
+
+func TestAllEndpointsFail(t *testing.T) {
+	ctx := context.Background()
+	c, e := NewMultiClient([]Endpoint{
+		{Network: "tcp", Address: closedAddr(t)},
+		{Network: "tcp", Address: closedAddr(t)},
+	}, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Ping(ctx); e == nil {
+		t.Fatal("An error should be returned")
+	}
+	// ejected endpoints are still tried when no other remain
+	if _, e = c.Ping(ctx); e == nil {
+		t.Fatal("An error should be returned")
+	}
+}
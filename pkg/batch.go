@@ -0,0 +1,190 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+const defaultBatchConcurrency = 4
+
+// A BatchItem is a message to scan in a batch
+type BatchItem struct {
+	// ID identifies the item in its BatchResult
+	ID string
+	// Body is the message
+	Body io.Reader
+	// Open is called to open the message when Body is nil, the
+	// message is closed after the request
+	Open func() (io.ReadCloser, error)
+}
+
+// A BatchResult is the outcome of a BatchItem
+type BatchResult struct {
+	ID string
+	// Index is the position of the item in the input
+	Index    int
+	Response *response.Response
+	Err      error
+}
+
+// BatchOptions configures a batch
+type BatchOptions struct {
+	// Concurrency is the number of requests in flight, 4 is used
+	// when it is zero or less
+	Concurrency int
+	// Ordered returns the results in input order instead of
+	// completion order
+	Ordered bool
+	// Request is applied to every request of the batch
+	Request *RequestOptions
+}
+
+func (o *BatchOptions) concurrency() int {
+	if o == nil || o.Concurrency <= 0 {
+		return defaultBatchConcurrency
+	}
+	return o.Concurrency
+}
+
+// ScanMany sends a request using method m for each item read from
+// items until it is closed or ctx is done. The results are sent on
+// the returned channel, which is closed once every started request
+// has completed. The results must be received until the channel is
+// closed or ctx is done.
+func (c *Client) ScanMany(ctx context.Context, m request.Method, items <-chan BatchItem, o *BatchOptions) <-chan BatchResult {
+	var ro *RequestOptions
+	var ordered bool
+
+	if o != nil {
+		ro, ordered = o.Request, o.Ordered
+	}
+	n := o.concurrency()
+	out := make(chan BatchResult)
+	// sem holds a slot for each item that has not been emitted,
+	// bounding both the requests in flight and the ordering buffer
+	sem := make(chan struct{}, n)
+	results := make(chan BatchResult, n)
+
+	go func() {
+		var wg sync.WaitGroup
+
+		defer close(out)
+		emitted := make(chan struct{})
+		go func() {
+			emit(ctx, results, out, sem, ordered)
+			close(emitted)
+		}()
+
+	loop:
+		for i := 0; ; i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break loop
+			}
+			var it BatchItem
+			var ok bool
+			select {
+			case it, ok = <-items:
+			case <-ctx.Done():
+			}
+			if !ok {
+				<-sem
+				break loop
+			}
+			wg.Add(1)
+			go func(i int, it BatchItem) {
+				defer wg.Done()
+				results <- c.scanItem(ctx, m, i, it, ro)
+			}(i, it)
+		}
+		wg.Wait()
+		close(results)
+		<-emitted
+	}()
+	return out
+}
+
+// emit sends the results to out releasing a slot for each, the
+// results are dropped once ctx is done
+func emit(ctx context.Context, results <-chan BatchResult, out chan<- BatchResult, sem <-chan struct{}, ordered bool) {
+	next := 0
+	pending := make(map[int]BatchResult)
+	send := func(r BatchResult) {
+		select {
+		case out <- r:
+		case <-ctx.Done():
+		}
+		<-sem
+	}
+	for r := range results {
+		if !ordered {
+			send(r)
+			continue
+		}
+		pending[r.Index] = r
+		for {
+			p, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			send(p)
+			next++
+		}
+	}
+}
+
+func (c *Client) scanItem(ctx context.Context, m request.Method, i int, it BatchItem, o *RequestOptions) (r BatchResult) {
+	r = BatchResult{ID: it.ID, Index: i}
+	body := it.Body
+	if body == nil && it.Open != nil {
+		var rc io.ReadCloser
+		if rc, r.Err = it.Open(); r.Err != nil {
+			return
+		}
+		defer rc.Close()
+		body = rc
+	}
+	r.Response, r.Err = c.Do(ctx, m, body, o)
+	return
+}
+
+// CheckBatch sends a CHECK request for each item and returns the
+// results in input order. The items that were not sent because
+// ctx is done have the context error.
+func (c *Client) CheckBatch(ctx context.Context, items []BatchItem, o *BatchOptions) (results []BatchResult) {
+	ch := make(chan BatchItem)
+	go func() {
+		defer close(ch)
+		for _, it := range items {
+			select {
+			case ch <- it:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results = make([]BatchResult, len(items))
+	done := make([]bool, len(items))
+	for r := range c.ScanMany(ctx, request.Check, ch, o) {
+		results[r.Index] = r
+		done[r.Index] = true
+	}
+	for i, ok := range done {
+		if !ok {
+			results[i] = BatchResult{ID: items[i].ID, Index: i, Err: ctx.Err()}
+		}
+	}
+	return
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+)
+
+type delayServer struct {
+	l        net.Listener
+	inflight int64
+	peak     int64
+}
+
+// newDelayServer waits the number of milliseconds given in the
+// Subject of each message and returns it as the score
+func newDelayServer(t *testing.T) (s *delayServer) {
+	s = &delayServer{}
+	s.l = newServer(t, s.serve)
+	return
+}
+
+func (s *delayServer) serve(conn net.Conn) {
+	n := atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+	for {
+		p := atomic.LoadInt64(&s.peak)
+		if n <= p || atomic.CompareAndSwapInt64(&s.peak, p, n) {
+			break
+		}
+	}
+
+	b, _ := ioutil.ReadAll(bufio.NewReader(conn))
+	var ms int
+	for _, line := range strings.Split(string(b), "\r\n") {
+		if strings.HasPrefix(line, "Subject: ") {
+			ms, _ = strconv.Atoi(strings.TrimPrefix(line, "Subject: "))
+		}
+	}
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	fmt.Fprintf(conn, "SPAMD/1.5 0 EX_OK\r\nSpam: False ; %d.0 / 5.0\r\n\r\n", ms)
+}
+
+func delayItems(delays ...int) (items []BatchItem) {
+	for i, d := range delays {
+		items = append(items, BatchItem{
+			ID:   "msg" + strconv.Itoa(i),
+			Body: strings.NewReader(fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", d)),
+		})
+	}
+	return
+}
+
+func newBatchClient(t *testing.T, s *delayServer) *Client {
+	c, e := NewClientWithOptions(WithEndpoint("tcp", s.l.Addr().String()))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	return c
+}
+
+func feed(items []BatchItem) <-chan BatchItem {
+	ch := make(chan BatchItem)
+	go func() {
+		for _, it := range items {
+			ch <- it
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func TestScanManyCompletionOrder(t *testing.T) {
+	ctx := context.Background()
+	s := newDelayServer(t)
+	c := newBatchClient(t, s)
+
+	var ids []string
+	for r := range c.ScanMany(ctx, request.Check, feed(delayItems(150, 10, 80)), &BatchOptions{Concurrency: 3}) {
+		if r.Err != nil {
+			t.Fatalf("Unexpected error: %s", r.Err)
+		}
+		if want := []float64{150, 10, 80}[r.Index]; r.Response.Score != want {
+			t.Errorf("Got %v want %v for %s", r.Response.Score, want, r.ID)
+		}
+		ids = append(ids, r.ID)
+	}
+	if got := strings.Join(ids, ","); got != "msg1,msg2,msg0" {
+		t.Errorf("Got %s want msg1,msg2,msg0", got)
+	}
+}
+
+func TestScanManyOrdered(t *testing.T) {
+	ctx := context.Background()
+	s := newDelayServer(t)
+	c := newBatchClient(t, s)
+
+	delays := []int{60, 0, 30, 0, 10, 0, 0, 20}
+	i := 0
+	for r := range c.ScanMany(ctx, request.Check, feed(delayItems(delays...)), &BatchOptions{Concurrency: 3, Ordered: true}) {
+		if r.Index != i || r.ID != "msg"+strconv.Itoa(i) {
+			t.Errorf("Got %d %s want %d", r.Index, r.ID, i)
+		}
+		if r.Err != nil || r.Response.Score != float64(delays[i]) {
+			t.Errorf("Got %v %v want %d", r.Err, r.Response, delays[i])
+		}
+		i++
+	}
+	if i != len(delays) {
+		t.Errorf("Got %d want %d results", i, len(delays))
+	}
+	if p := atomic.LoadInt64(&s.peak); p > 3 {
+		t.Errorf("Got %d want at most %d requests in flight", p, 3)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed *int32
+}
+
+func (c closeRecorder) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return nil
+}
+
+func TestCheckBatch(t *testing.T) {
+	ctx := context.Background()
+	s := newDelayServer(t)
+	c := newBatchClient(t, s)
+
+	var closed int32
+	openErr := errors.New("no such message")
+	items := delayItems(20, 0)
+	items = append(items,
+		BatchItem{ID: "lazy", Open: func() (io.ReadCloser, error) {
+			return closeRecorder{strings.NewReader("Subject: 5\r\n\r\nbody\r\n"), &closed}, nil
+		}},
+		BatchItem{ID: "missing", Open: func() (io.ReadCloser, error) {
+			return nil, openErr
+		}},
+	)
+	results := c.CheckBatch(ctx, items, nil)
+	if len(results) != 4 {
+		t.Fatalf("Got %d want %d results", len(results), 4)
+	}
+	for i, id := range []string{"msg0", "msg1", "lazy"} {
+		if r := results[i]; r.ID != id || r.Err != nil {
+			t.Errorf("Got %s %v want %s", r.ID, r.Err, id)
+		}
+	}
+	if results[2].Response.Score != 5 || atomic.LoadInt32(&closed) != 1 {
+		t.Errorf("Got %v %d want the lazily opened message closed", results[2].Response.Score, closed)
+	}
+	if !errors.Is(results[3].Err, openErr) {
+		t.Errorf("Got %v want %v", results[3].Err, openErr)
+	}
+}
+
+func TestCheckBatchCancel(t *testing.T) {
+	s := newDelayServer(t)
+	c := newBatchClient(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results := c.CheckBatch(ctx, delayItems(0, 2000, 2000, 2000, 0, 0), &BatchOptions{Concurrency: 2})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("The batch took %s, it should stop when the context is done", d)
+	}
+	if results[0].Err != nil {
+		t.Errorf("Unexpected error: %s", results[0].Err)
+	}
+	for _, r := range results[1:] {
+		if !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Errorf("Got %v want %v for %s", r.Err, context.DeadlineExceeded, r.ID)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// compress returns the zlib compressed form of b, spamd requires the
+// Content-length to be the length of the compressed payload so the
+// whole body is compressed before the request is sent
+func (s *settings) compress(b *body) (cb *body, err error) {
+	var w *zlib.Writer
+	var buf bytes.Buffer
+
+	if w, err = zlib.NewWriterLevel(&buf, s.compressionLevel); err != nil {
+		return
+	}
+	if _, err = io.CopyN(w, b.r, b.size); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	cb = &body{
+		r:          bytes.NewReader(buf.Bytes()),
+		size:       int64(buf.Len()),
+		start:      0,
+		compressed: true,
+	}
+	return
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompressionLevel(t *testing.T) {
+	c, e := NewClient("tcp", "127.1.1.1:4010", "exim", true)
+	if e != nil {
+		t.Fatal("An error should not be returned")
+	}
+	if c.compressionLevel != zlib.DefaultCompression {
+		t.Errorf("Got %d want %d", c.compressionLevel, zlib.DefaultCompression)
+	}
+	c.SetCompressionLevel(zlib.BestSpeed)
+	if c.compressionLevel != zlib.BestSpeed {
+		t.Errorf("Got %d want %d", c.compressionLevel, zlib.BestSpeed)
+	}
+	c.SetCompressionLevel(20)
+	if c.compressionLevel != zlib.BestSpeed {
+		t.Errorf("Got %d want %d", c.compressionLevel, zlib.BestSpeed)
+	}
+	c.SetCompressionMinSize(1024)
+	if c.compressionMinSize != 1024 {
+		t.Errorf("Got %d want %d", c.compressionMinSize, 1024)
+	}
+}
+
+func TestCompressedRequest(t *testing.T) {
+	ctx := context.Background()
+	s := newCheckServer(t)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", true)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	msg := "Subject: compressed\r\n\r\n" + strings.Repeat("Message body\r\n", 50)
+	if _, e = c.Check(ctx, strings.NewReader(msg)); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+
+	c.SetCompressionMinSize(int64(len(msg) + 1))
+	if _, e = c.Check(ctx, strings.NewReader(msg)); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+
+	rq := s.Requests()
+	if len(rq) != 2 {
+		t.Fatalf("Got %d want %d requests", len(rq), 2)
+	}
+
+	// compressed
+	if v := rq[0].header.Get("Compress"); v != "zlib" {
+		t.Errorf("Got %q want %q", v, "zlib")
+	}
+	if v := rq[0].header.Get("Content-length"); v != strconv.Itoa(len(rq[0].body)) {
+		t.Errorf("Got %s want %d", v, len(rq[0].body))
+	}
+	if len(rq[0].trailer) != 0 {
+		t.Errorf("Got %q want no data after the compressed body", rq[0].trailer)
+	}
+	zr, e := zlib.NewReader(bytes.NewReader(rq[0].body))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	b, e := ioutil.ReadAll(zr)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if string(b) != msg {
+		t.Errorf("The decompressed body does not match")
+	}
+
+	// below the minimum size
+	if v := rq[1].header.Get("Compress"); v != "" {
+		t.Errorf("Got %q want %q", v, "")
+	}
+	if string(rq[1].body) != msg+"\r\n" {
+		t.Errorf("Got %q want %q", rq[1].body, msg+"\r\n")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+const (
+	dialErr   = "Failed to connect to %s %s: %s"
+	serverErr = "Server returned %s: %s"
+)
+
+var (
+	// ErrNoSize is returned when the length of a message can not be
+	// determined and spooling is disabled
+	ErrNoSize = errors.New(noSizeErr)
+	// ErrInvalidLearnType is returned when a TELL request does not
+	// have a valid message type
+	ErrInvalidLearnType = errors.New(invalidLearnTypeErr)
+	// ErrNoResponse is returned when the server closes the connection
+	// without sending a response
+	ErrNoResponse = errors.New(responseReadErr)
+)
+
+// A ProtocolError is returned when the server response can not be parsed
+type ProtocolError struct {
+	// Line is the offending line
+	Line string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf(invalidRespErr, e.Line)
+}
+
+// A ServerError is returned when the server responds with a status
+// other than EX_OK, the response is returned along with the error.
+type ServerError struct {
+	Code response.StatusCode
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf(serverErr, e.Code, e.Code.Error())
+}
+
+// Unwrap returns the status code, so errors.Is(err, response.ExTempFail)
+// can be used to check for a status
+func (e *ServerError) Unwrap() error {
+	return e.Code
+}
+
+// Temporary returns true when the status is temporary
+func (e *ServerError) Temporary() bool {
+	return e.Code.IsTemp()
+}
+
+// A DialError is returned when the connection to an endpoint could
+// not be established, the message was not sent to the endpoint.
+type DialError struct {
+	Network string
+	Address string
+	Err     error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf(dialErr, e.Network, e.Address, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary returns true, another attempt or endpoint may succeed
+func (e *DialError) Temporary() bool {
+	return true
+}
+
+// IsTemporary returns true when err is a failure that may succeed
+// when retried: a dial failure, a timeout or a temporary server status.
+// Context errors are not temporary.
+func IsTemporary(err error) (b bool) {
+	var de *DialError
+	var se *ServerError
+	var ne net.Error
+
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+	case errors.As(err, &de):
+		b = true
+	case errors.As(err, &se):
+		b = se.Temporary()
+	case errors.As(err, &ne):
+		b = ne.Timeout()
+	}
+	return
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+func TestProtocolError(t *testing.T) {
+	s := newCannedServer(t, "HTTP/1.1 400 Bad Request\r\n\r\n")
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	_, e = c.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\n"))
+	var pe *ProtocolError
+	if !errors.As(e, &pe) {
+		t.Fatalf("Got %v want a ProtocolError", e)
+	}
+	if pe.Line != "HTTP/1.1 400 Bad Request" {
+		t.Errorf("Got %q want %q", pe.Line, "HTTP/1.1 400 Bad Request")
+	}
+	if IsTemporary(e) {
+		t.Errorf("A ProtocolError should not be temporary")
+	}
+
+	s = newCannedServer(t, "")
+	c, _ = NewClient("tcp", s.l.Addr().String(), "exim", false)
+	_, e = c.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\n"))
+	if !errors.Is(e, ErrNoResponse) {
+		t.Errorf("Got %v want %s", e, ErrNoResponse)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	tests := []struct {
+		reply string
+		code  response.StatusCode
+		temp  bool
+	}{
+		{"SPAMD/1.5 75 EX_TEMPFAIL\r\n", response.ExTempFail, true},
+		{"SPAMD/1.5 77 EX_NOPERM\r\n", response.ExNoPerm, false},
+	}
+	for _, tt := range tests {
+		s := newCannedServer(t, tt.reply)
+		c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		rs, e := c.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\n"))
+		var se *ServerError
+		if !errors.As(e, &se) {
+			t.Fatalf("Got %v want a ServerError", e)
+		}
+		if se.Code != tt.code || !errors.Is(e, tt.code) {
+			t.Errorf("Got %q want %q", se.Code, tt.code)
+		}
+		if rs == nil || rs.StatusCode != tt.code {
+			t.Errorf("The response should be returned with the error")
+		}
+		if IsTemporary(e) != tt.temp {
+			t.Errorf("Got %t want %t for %q", IsTemporary(e), tt.temp, tt.code)
+		}
+	}
+}
+
+func TestDialError(t *testing.T) {
+	addr := closedAddr(t)
+	c, e := NewClient("tcp", addr, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	_, e = c.Ping(context.Background())
+	var de *DialError
+	if !errors.As(e, &de) {
+		t.Fatalf("Got %v want a DialError", e)
+	}
+	if de.Network != "tcp" || de.Address != addr {
+		t.Errorf("Got %s %s want tcp %s", de.Network, de.Address, addr)
+	}
+	var oe *net.OpError
+	if !errors.As(e, &oe) {
+		t.Errorf("The dial error should be wrapped: %v", e)
+	}
+	if !IsTemporary(e) {
+		t.Errorf("A DialError should be temporary")
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	c, e := NewClient("tcp", "127.1.1.1:4010", "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	_, e = c.Do(context.Background(), request.Tell, strings.NewReader(""), nil)
+	if !errors.Is(e, ErrInvalidLearnType) {
+		t.Errorf("Got %v want %s", e, ErrInvalidLearnType)
+	}
+	c.DisableSpooling()
+	_, e = c.Check(context.Background(), struct{ io.Reader }{strings.NewReader("")})
+	if !errors.Is(e, ErrNoSize) {
+		t.Errorf("Got %v want %s", e, ErrNoSize)
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		temp bool
+	}{
+		{nil, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{ErrNoSize, false},
+		{&ServerError{Code: response.ExTimeout}, true},
+		{fmt.Errorf("wrapped: %w", &ServerError{Code: response.ExTempFail}), true},
+		{&DialError{Err: context.Canceled}, false},
+		{&DialError{Err: fmt.Errorf("refused")}, true},
+		{&net.OpError{Op: "read", Err: timeoutErr{}}, true},
+	}
+	for _, tt := range tests {
+		if b := IsTemporary(tt.err); b != tt.temp {
+			t.Errorf("IsTemporary(%v) = %t, want %t", tt.err, b, tt.temp)
+		}
+	}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
@@ -0,0 +1,170 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+)
+
+const (
+	// LevelDebug logs dial attempts and completed requests
+	LevelDebug LogLevel = iota - 1
+	// LevelInfo logs retries
+	LevelInfo
+	// LevelWarn logs failovers, protocol anomalies and slow requests
+	LevelWarn
+	// LevelError logs failed requests
+	LevelError
+)
+
+const defaultSlowThreshold = 10 * time.Second
+
+// A LogLevel is the severity of a log message
+type LogLevel int
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// A Logger receives leveled messages with alternating key value
+// pairs, a *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, kv ...interface{}) {}
+func (nopLogger) Info(msg string, kv ...interface{})  {}
+func (nopLogger) Warn(msg string, kv ...interface{})  {}
+func (nopLogger) Error(msg string, kv ...interface{}) {}
+
+// stdLogger adapts a *log.Logger, the pairs are written as key=value
+type stdLogger struct {
+	l     *stdlog.Logger
+	level LogLevel
+}
+
+// NewStdLogger returns a Logger writing messages at level or
+// above to l in the key=value format
+func NewStdLogger(l *stdlog.Logger, level LogLevel) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+func (s *stdLogger) Debug(msg string, kv ...interface{}) { s.log(LevelDebug, msg, kv) }
+func (s *stdLogger) Info(msg string, kv ...interface{})  { s.log(LevelInfo, msg, kv) }
+func (s *stdLogger) Warn(msg string, kv ...interface{})  { s.log(LevelWarn, msg, kv) }
+func (s *stdLogger) Error(msg string, kv ...interface{}) { s.log(LevelError, msg, kv) }
+
+func (s *stdLogger) log(level LogLevel, msg string, kv []interface{}) {
+	if level < s.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	b.WriteString(logValue(msg))
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		if i+1 == len(kv) {
+			b.WriteString("!BADKEY=")
+			b.WriteString(logValue(fmt.Sprint(kv[i])))
+			break
+		}
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		b.WriteString(logValue(fmt.Sprint(kv[i+1])))
+	}
+	s.l.Output(3, b.String())
+}
+
+// logValue quotes v when it is empty or has spaces, quotes or
+// control characters
+func logValue(v string) string {
+	if v == "" || strings.IndexFunc(v, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// logRequest logs a completed request, failures are logged as
+// errors and requests over the slow threshold as warnings
+func (s *settings) logRequest(st *RequestStats) {
+	kv := []interface{}{
+		"method", st.Method,
+		"user", s.user,
+		"endpoint", st.Endpoint.Address,
+		"attempts", st.Attempts,
+		"duration", st.Duration,
+	}
+	if s.slowThreshold > 0 && st.Duration > s.slowThreshold {
+		s.logger.Warn("slow spamd request", kv...)
+	}
+	if st.Err != nil {
+		s.logger.Error("spamd request failed", append(kv, "error", st.Err)...)
+		return
+	}
+	s.logger.Debug("spamd request", append(kv, "status", st.Code.String())...)
+}
+
+// logAnomaly logs responses that do not follow the protocol
+func (s *settings) logAnomaly(ep *endpoint, rq request.Method, err error) {
+	var pe *ProtocolError
+	switch {
+	case errors.As(err, &pe):
+		s.logger.Warn("invalid spamd response", "endpoint", ep.Address, "method", rq,
+			"user", s.user, "line", pe.Line)
+	case errors.Is(err, ErrNoResponse), errors.Is(err, io.ErrUnexpectedEOF):
+		s.logger.Warn("spamd closed the connection early", "endpoint", ep.Address,
+			"method", rq, "user", s.user, "error", err)
+	}
+}
+
+// SetLogger sets the Logger, nil disables logging
+func (c *Client) SetLogger(l Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if l == nil {
+		l = nopLogger{}
+	}
+	c.logger = l
+}
+
+// SetSlowThreshold sets the duration above which a request is
+// logged as slow, zero disables it
+func (c *Client) SetSlowThreshold(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if d >= 0 {
+		c.slowThreshold = d
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type logRecord struct {
+	level LogLevel
+	msg   string
+	kv    map[string]string
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (l *recordingLogger) add(level LogLevel, msg string, kv []interface{}) {
+	r := logRecord{level: level, msg: msg, kv: make(map[string]string)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		r.kv[fmt.Sprint(kv[i])] = fmt.Sprint(kv[i+1])
+	}
+	l.mu.Lock()
+	l.records = append(l.records, r)
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Debug(msg string, kv ...interface{}) { l.add(LevelDebug, msg, kv) }
+func (l *recordingLogger) Info(msg string, kv ...interface{})  { l.add(LevelInfo, msg, kv) }
+func (l *recordingLogger) Warn(msg string, kv ...interface{})  { l.add(LevelWarn, msg, kv) }
+func (l *recordingLogger) Error(msg string, kv ...interface{}) { l.add(LevelError, msg, kv) }
+
+func (l *recordingLogger) find(msg string) (r *logRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.records {
+		if l.records[i].msg == msg {
+			return &l.records[i]
+		}
+	}
+	return
+}
+
+func TestStdLogger(t *testing.T) {
+	var b bytes.Buffer
+
+	l := NewStdLogger(stdlog.New(&b, "", 0), LevelInfo)
+	l.Debug("hidden")
+	l.Info("retrying", "endpoint", "127.0.0.1:783", "error", errors.New("i/o timeout"), "attempt", 2)
+	l.Error("odd", "key")
+
+	expected := "level=INFO msg=retrying endpoint=127.0.0.1:783 error=\"i/o timeout\" attempt=2\n" +
+		"level=ERROR msg=odd !BADKEY=key\n"
+	if b.String() != expected {
+		t.Errorf("Got %q want %q", b.String(), expected)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	for l, s := range map[LogLevel]string{
+		LevelDebug: "DEBUG",
+		LevelInfo:  "INFO",
+		LevelWarn:  "WARN",
+		LevelError: "ERROR",
+		5:          "LEVEL(5)",
+	} {
+		if l.String() != s {
+			t.Errorf("Got %s want %s", l, s)
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	ctx := context.Background()
+	msg := "Subject: test\r\n\r\n"
+
+	// dial failures
+	l := &recordingLogger{}
+	addr := closedAddr(t)
+	c, e := NewClientWithOptions(WithEndpoint("tcp", addr), WithUser("exim"), WithLogger(l))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Check(ctx, strings.NewReader(msg)); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	if r := l.find("dialing spamd"); r == nil || r.level != LevelDebug || r.kv["endpoint"] != addr {
+		t.Errorf("Got %+v want the dial attempt", r)
+	}
+	if r := l.find("spamd dial failed"); r == nil || r.level != LevelWarn || r.kv["error"] == "" {
+		t.Errorf("Got %+v want the dial failure", r)
+	}
+	r := l.find("spamd request failed")
+	if r == nil || r.level != LevelError || r.kv["method"] != "CHECK" || r.kv["user"] != "exim" || r.kv["duration"] == "" {
+		t.Errorf("Got %+v want the request failure", r)
+	}
+
+	// retries and slow requests
+	l = &recordingLogger{}
+	s := newSeqServer(t, tempFailReply, checkReply)
+	c, e = NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}),
+		WithSlowThreshold(time.Nanosecond),
+		WithLogger(l),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Check(ctx, strings.NewReader(msg)); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if r = l.find("retrying spamd request"); r == nil || r.level != LevelInfo || r.kv["attempt"] != "1" || r.kv["backoff"] == "" {
+		t.Errorf("Got %+v want the retry", r)
+	}
+	if r = l.find("slow spamd request"); r == nil || r.level != LevelWarn || r.kv["attempts"] != "2" {
+		t.Errorf("Got %+v want the slow request", r)
+	}
+	if r = l.find("spamd request"); r == nil || r.kv["status"] != "EX_OK" {
+		t.Errorf("Got %+v want the completed request", r)
+	}
+
+	// protocol anomalies
+	l = &recordingLogger{}
+	p := newCannedServer(t, "HTTP/1.1 400 Bad Request\r\n")
+	c, e = NewClientWithOptions(WithEndpoint("tcp", p.l.Addr().String()), WithLogger(l))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Check(ctx, strings.NewReader(msg)); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	if r = l.find("invalid spamd response"); r == nil || r.kv["line"] != "HTTP/1.1 400 Bad Request" {
+		t.Errorf("Got %+v want the protocol error", r)
+	}
+
+	c.SetLogger(nil)
+	c.SetSlowThreshold(0)
+	if c.slowThreshold != 0 {
+		t.Errorf("Got %v want %v", c.slowThreshold, 0)
+	}
+	if _, ok := c.logger.(nopLogger); !ok {
+		t.Errorf("Got %T want nopLogger", c.logger)
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+const (
+	metricsPrefix = "spamd_client_"
+	// errorStatus is the status label of a request that failed
+	// without a status from the server
+	errorStatus = "ERROR"
+)
+
+// DefaultBuckets are the latency histogram buckets in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// A Histogram counts observations in buckets, Counts[i] is the
+// number of observations less than or equal to Buckets[i]
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: buckets,
+		Counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, b := range h.Buckets {
+		if v <= b {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += v
+}
+
+func (h *Histogram) clone() *Histogram {
+	c := *h
+	c.Counts = append([]uint64(nil), h.Counts...)
+	return &c
+}
+
+// MethodMetrics are the metrics of a request method
+type MethodMetrics struct {
+	// Requests counts the requests by status
+	Requests map[string]uint64
+	// Attempts counts the attempts by status
+	Attempts map[string]uint64
+	Duration *Histogram
+}
+
+// EndpointMetrics are the metrics of an endpoint
+type EndpointMetrics struct {
+	// Attempts counts the attempts by status
+	Attempts      map[string]uint64
+	Dials         uint64
+	DialErrors    uint64
+	TLSErrors     uint64
+	BytesSent     uint64
+	BytesReceived uint64
+	Duration      *Histogram
+	Connect       *Histogram
+	TLSHandshake  *Histogram
+	FirstByte     *Histogram
+	Parse         *Histogram
+}
+
+// A MetricsSnapshot is a copy of the metrics at a point in time
+type MetricsSnapshot struct {
+	// Methods is keyed by method name
+	Methods map[string]*MethodMetrics
+	// Endpoints is keyed by endpoint address
+	Endpoints map[string]*EndpointMetrics
+}
+
+// Metrics is an Observer that aggregates counters and latency
+// histograms per method and per endpoint.
+type Metrics struct {
+	NopObserver
+
+	buckets []float64
+	mu      sync.Mutex
+	snap    MetricsSnapshot
+}
+
+// NewMetrics returns a Metrics using buckets, DefaultBuckets
+// are used when none are given
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Metrics{
+		buckets: b,
+		snap: MetricsSnapshot{
+			Methods:   make(map[string]*MethodMetrics),
+			Endpoints: make(map[string]*EndpointMetrics),
+		},
+	}
+}
+
+// method must be called with m.mu held
+func (m *Metrics) method(name string) (mm *MethodMetrics) {
+	if mm = m.snap.Methods[name]; mm == nil {
+		mm = &MethodMetrics{
+			Requests: make(map[string]uint64),
+			Attempts: make(map[string]uint64),
+			Duration: newHistogram(m.buckets),
+		}
+		m.snap.Methods[name] = mm
+	}
+	return
+}
+
+// endpoint must be called with m.mu held
+func (m *Metrics) endpoint(addr string) (em *EndpointMetrics) {
+	if em = m.snap.Endpoints[addr]; em == nil {
+		em = &EndpointMetrics{
+			Attempts:     make(map[string]uint64),
+			Duration:     newHistogram(m.buckets),
+			Connect:      newHistogram(m.buckets),
+			TLSHandshake: newHistogram(m.buckets),
+			FirstByte:    newHistogram(m.buckets),
+			Parse:        newHistogram(m.buckets),
+		}
+		m.snap.Endpoints[addr] = em
+	}
+	return
+}
+
+// DialDone counts the dial
+func (m *Metrics) DialDone(ep Endpoint, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	em := m.endpoint(ep.Address)
+	em.Dials++
+	if err != nil {
+		em.DialErrors++
+	}
+}
+
+// TLSHandshakeDone counts failed handshakes
+func (m *Metrics) TLSHandshakeDone(ep Endpoint, err error) {
+	if err == nil {
+		return
+	}
+	m.mu.Lock()
+	m.endpoint(ep.Address).TLSErrors++
+	m.mu.Unlock()
+}
+
+// AttemptDone records the attempt
+func (m *Metrics) AttemptDone(a *AttemptStats) {
+	status := statusLabel(a.Code, a.HasStatus, a.Err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.method(a.Method.String()).Attempts[status]++
+	em := m.endpoint(a.Endpoint.Address)
+	em.Attempts[status]++
+	em.BytesSent += uint64(a.BytesSent)
+	em.BytesReceived += uint64(a.BytesReceived)
+	em.Duration.observe(a.Duration)
+	em.Connect.observe(a.Connect)
+	if a.TLSHandshake > 0 {
+		em.TLSHandshake.observe(a.TLSHandshake)
+	}
+	if a.BytesReceived > 0 {
+		em.FirstByte.observe(a.FirstByte)
+	}
+	if a.HasStatus {
+		em.Parse.observe(a.Parse)
+	}
+}
+
+// RequestDone records the request
+func (m *Metrics) RequestDone(r *RequestStats) {
+	status := statusLabel(r.Code, r.HasStatus, r.Err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mm := m.method(r.Method.String())
+	mm.Requests[status]++
+	mm.Duration.observe(r.Duration)
+}
+
+// statusLabel returns the status of a request, errorStatus is
+// used when the server did not return a status
+func statusLabel(code response.StatusCode, ok bool, err error) string {
+	var se *ServerError
+	if errors.As(err, &se) {
+		return se.Code.String()
+	}
+	if err != nil || !ok {
+		return errorStatus
+	}
+	return code.String()
+}
+
+// Snapshot returns a copy of the metrics
+func (m *Metrics) Snapshot() (s *MetricsSnapshot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s = &MetricsSnapshot{
+		Methods:   make(map[string]*MethodMetrics, len(m.snap.Methods)),
+		Endpoints: make(map[string]*EndpointMetrics, len(m.snap.Endpoints)),
+	}
+	for k, v := range m.snap.Methods {
+		c := *v
+		c.Requests = copyCounts(v.Requests)
+		c.Attempts = copyCounts(v.Attempts)
+		c.Duration = v.Duration.clone()
+		s.Methods[k] = &c
+	}
+	for k, v := range m.snap.Endpoints {
+		c := *v
+		c.Attempts = copyCounts(v.Attempts)
+		c.Duration = v.Duration.clone()
+		c.Connect = v.Connect.clone()
+		c.TLSHandshake = v.TLSHandshake.clone()
+		c.FirstByte = v.FirstByte.clone()
+		c.Parse = v.Parse.clone()
+		s.Endpoints[k] = &c
+	}
+	return
+}
+
+// WritePrometheus writes a snapshot of the metrics to w in the
+// Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	return m.Snapshot().WritePrometheus(w)
+}
+
+func copyCounts(m map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// WritePrometheus writes the snapshot to w in the Prometheus
+// text exposition format
+func (s *MetricsSnapshot) WritePrometheus(w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+	p := &promWriter{w: bw}
+
+	methods := make([]string, 0, len(s.Methods))
+	for k := range s.Methods {
+		methods = append(methods, k)
+	}
+	sort.Strings(methods)
+	endpoints := make([]string, 0, len(s.Endpoints))
+	for k := range s.Endpoints {
+		endpoints = append(endpoints, k)
+	}
+	sort.Strings(endpoints)
+
+	p.header("requests_total", "counter", "Requests by method and status.")
+	for _, k := range methods {
+		p.counts("requests_total", "method", k, s.Methods[k].Requests)
+	}
+	p.header("request_duration_seconds", "histogram", "Request latency by method including retries.")
+	for _, k := range methods {
+		p.histogram("request_duration_seconds", "method", k, s.Methods[k].Duration)
+	}
+	p.header("method_attempts_total", "counter", "Attempts by method and status.")
+	for _, k := range methods {
+		p.counts("method_attempts_total", "method", k, s.Methods[k].Attempts)
+	}
+
+	p.header("attempts_total", "counter", "Attempts by endpoint and status.")
+	for _, k := range endpoints {
+		p.counts("attempts_total", "endpoint", k, s.Endpoints[k].Attempts)
+	}
+	for _, c := range []struct {
+		name, help string
+		v          func(*EndpointMetrics) uint64
+	}{
+		{"dials_total", "Connections dialed by endpoint.", func(e *EndpointMetrics) uint64 { return e.Dials }},
+		{"dial_errors_total", "Failed dials by endpoint.", func(e *EndpointMetrics) uint64 { return e.DialErrors }},
+		{"tls_errors_total", "Failed TLS handshakes by endpoint.", func(e *EndpointMetrics) uint64 { return e.TLSErrors }},
+		{"sent_bytes_total", "Bytes sent by endpoint.", func(e *EndpointMetrics) uint64 { return e.BytesSent }},
+		{"received_bytes_total", "Bytes received by endpoint.", func(e *EndpointMetrics) uint64 { return e.BytesReceived }},
+	} {
+		p.header(c.name, "counter", c.help)
+		for _, k := range endpoints {
+			p.sample(c.name, labels("endpoint", k), strconv.FormatUint(c.v(s.Endpoints[k]), 10))
+		}
+	}
+	for _, h := range []struct {
+		name, help string
+		v          func(*EndpointMetrics) *Histogram
+	}{
+		{"attempt_duration_seconds", "Attempt latency by endpoint.", func(e *EndpointMetrics) *Histogram { return e.Duration }},
+		{"connect_duration_seconds", "Time to obtain a connection by endpoint.", func(e *EndpointMetrics) *Histogram { return e.Connect }},
+		{"tls_handshake_duration_seconds", "TLS handshake latency by endpoint.", func(e *EndpointMetrics) *Histogram { return e.TLSHandshake }},
+		{"first_byte_duration_seconds", "Time to first response byte by endpoint.", func(e *EndpointMetrics) *Histogram { return e.FirstByte }},
+		{"parse_duration_seconds", "Response read and parse time by endpoint.", func(e *EndpointMetrics) *Histogram { return e.Parse }},
+	} {
+		p.header(h.name, "histogram", h.help)
+		for _, k := range endpoints {
+			p.histogram(h.name, "endpoint", k, h.v(s.Endpoints[k]))
+		}
+	}
+
+	if p.err != nil {
+		return p.err
+	}
+	return bw.Flush()
+}
+
+// promWriter writes samples and keeps the first error
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.printf("# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, typ)
+}
+
+func (p *promWriter) sample(name, labels, value string) {
+	p.printf("%s%s{%s} %s\n", metricsPrefix, name, labels, value)
+}
+
+func (p *promWriter) counts(name, label, value string, counts map[string]uint64) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, status := range keys {
+		p.sample(name, labels(label, value, "status", status), strconv.FormatUint(counts[status], 10))
+	}
+}
+
+func (p *promWriter) histogram(name, label, value string, h *Histogram) {
+	for i, b := range h.Buckets {
+		p.sample(name+"_bucket", labels(label, value, "le", formatFloat(b)), strconv.FormatUint(h.Counts[i], 10))
+	}
+	p.sample(name+"_bucket", labels(label, value, "le", "+Inf"), strconv.FormatUint(h.Count, 10))
+	p.sample(name+"_sum", labels(label, value), formatFloat(h.Sum))
+	p.sample(name+"_count", labels(label, value), strconv.FormatUint(h.Count, 10))
+}
+
+// labels formats name value pairs as a label set
+func labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", kv[i], escapeLabel(kv[i+1]))
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(50 * time.Millisecond)
+	h.observe(500 * time.Millisecond)
+	h.observe(2 * time.Second)
+	if h.Counts[0] != 1 || h.Counts[1] != 2 || h.Count != 3 {
+		t.Errorf("Got %v %d want [1 2] 3", h.Counts, h.Count)
+	}
+	if h.Sum != 2.55 {
+		t.Errorf("Got %v want %v", h.Sum, 2.55)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	srv := newSeqServer(t, tempFailReply, checkReply)
+	m := NewMetrics(1, 0.5)
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", srv.l.Addr().String()),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}),
+		WithObserver(m),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n")); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+
+	s := m.Snapshot()
+	mm := s.Methods["CHECK"]
+	if mm == nil || mm.Requests["EX_OK"] != 1 || mm.Attempts["EX_TEMPFAIL"] != 1 || mm.Duration.Count != 1 {
+		t.Fatalf("Got %+v want the CHECK metrics", mm)
+	}
+	em := s.Endpoints[srv.l.Addr().String()]
+	if em == nil || em.Attempts["EX_TEMPFAIL"] != 1 || em.Attempts["EX_OK"] != 1 || em.Dials != 2 {
+		t.Fatalf("Got %+v want the endpoint metrics", em)
+	}
+	if em.BytesReceived != uint64(len(tempFailReply)+len(checkReply)) || em.FirstByte.Count != 2 || em.BytesSent == 0 {
+		t.Errorf("Got %d %d %d want the byte counts", em.BytesReceived, em.FirstByte.Count, em.BytesSent)
+	}
+
+	// the snapshot is a copy
+	mm.Requests["EX_OK"] = 10
+	if m.Snapshot().Methods["CHECK"].Requests["EX_OK"] != 1 {
+		t.Errorf("The snapshot should not share the counters")
+	}
+}
+
+func TestStatusLabel(t *testing.T) {
+	tests := []struct {
+		code     response.StatusCode
+		ok       bool
+		err      error
+		expected string
+	}{
+		{response.ExOK, true, nil, "EX_OK"},
+		{response.ExNoPerm, true, &ServerError{Code: response.ExNoPerm}, "EX_NOPERM"},
+		{response.ExOK, false, errors.New("dial"), errorStatus},
+		{response.ExOK, false, nil, errorStatus},
+	}
+	for _, tt := range tests {
+		if s := statusLabel(tt.code, tt.ok, tt.err); s != tt.expected {
+			t.Errorf("Got %s want %s", s, tt.expected)
+		}
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var b bytes.Buffer
+
+	m := NewMetrics(0.5, 1)
+	ep := Endpoint{Network: "tcp", Address: `spamd"1:783`}
+	m.DialDone(ep, nil)
+	m.AttemptDone(&AttemptStats{
+		Method:        request.Check,
+		Endpoint:      ep,
+		Code:          response.ExOK,
+		HasStatus:     true,
+		BytesSent:     100,
+		BytesReceived: 50,
+		Connect:       time.Millisecond,
+		FirstByte:     250 * time.Millisecond,
+		Duration:      750 * time.Millisecond,
+	})
+	m.RequestDone(&RequestStats{Method: request.Check, Code: response.ExOK, HasStatus: true, Attempts: 1, Duration: 750 * time.Millisecond})
+
+	if e := m.WritePrometheus(&b); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	out := b.String()
+	for _, l := range []string{
+		"# TYPE spamd_client_requests_total counter\n",
+		`spamd_client_requests_total{method="CHECK",status="EX_OK"} 1` + "\n",
+		"# TYPE spamd_client_request_duration_seconds histogram\n",
+		`spamd_client_request_duration_seconds_bucket{method="CHECK",le="0.5"} 0` + "\n",
+		`spamd_client_request_duration_seconds_bucket{method="CHECK",le="1"} 1` + "\n",
+		`spamd_client_request_duration_seconds_bucket{method="CHECK",le="+Inf"} 1` + "\n",
+		`spamd_client_request_duration_seconds_sum{method="CHECK"} 0.75` + "\n",
+		`spamd_client_request_duration_seconds_count{method="CHECK"} 1` + "\n",
+		`spamd_client_attempts_total{endpoint="spamd\"1:783",status="EX_OK"} 1` + "\n",
+		`spamd_client_dials_total{endpoint="spamd\"1:783"} 1` + "\n",
+		`spamd_client_sent_bytes_total{endpoint="spamd\"1:783"} 100` + "\n",
+		`spamd_client_first_byte_duration_seconds_bucket{endpoint="spamd\"1:783",le="0.5"} 1` + "\n",
+	} {
+		if !strings.Contains(out, l) {
+			t.Errorf("Missing %q in\n%s", l, out)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+// An Observer is called by the client at each phase of a request,
+// in the manner of net/http/httptrace. A request is made of one or
+// more attempts, each against a single endpoint.
+//
+// The methods may be called concurrently from several requests and
+// must not block. Embed NopObserver to implement only some of them.
+type Observer interface {
+	// RequestStart is called before the request body is prepared
+	RequestStart(m request.Method)
+	// DialStart and DialDone are called around each connection
+	// attempt, pre-dialed connections are dialed in the background
+	DialStart(ep Endpoint)
+	DialDone(ep Endpoint, err error)
+	// TLSHandshakeStart and TLSHandshakeDone are called around the
+	// TLS handshake when TLS is used
+	TLSHandshakeStart(ep Endpoint)
+	TLSHandshakeDone(ep Endpoint, err error)
+	// WroteRequest is called once the request has been written
+	WroteRequest(ep Endpoint, err error)
+	// GotFirstResponseByte is called when the first byte of the
+	// response is read
+	GotFirstResponseByte(ep Endpoint)
+	// AttemptDone is called when an attempt against an endpoint ends
+	AttemptDone(a *AttemptStats)
+	// RequestDone is called when the request ends
+	RequestDone(r *RequestStats)
+}
+
+// AttemptStats describes a single attempt of a request
+type AttemptStats struct {
+	Method   request.Method
+	Endpoint Endpoint
+	// Code is the status returned by the server, it is only
+	// meaningful when HasStatus is set
+	Code      response.StatusCode
+	HasStatus bool
+	// BytesSent and BytesReceived count the bytes on the wire
+	BytesSent     int64
+	BytesReceived int64
+	// Connect is the time taken to obtain a connection including
+	// the TLS handshake, TLSHandshake is the handshake alone
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// FirstByte is the time from the start of the attempt to the
+	// first byte of the response
+	FirstByte time.Duration
+	// Parse is the time spent reading and parsing the response
+	// after the status line
+	Parse    time.Duration
+	Duration time.Duration
+	Err      error
+}
+
+// RequestStats describes a request once it has ended
+type RequestStats struct {
+	Method request.Method
+	// Endpoint is the endpoint of the last attempt
+	Endpoint  Endpoint
+	Code      response.StatusCode
+	HasStatus bool
+	Attempts  int
+	Duration  time.Duration
+	Err       error
+}
+
+// NopObserver is an Observer that does nothing
+type NopObserver struct{}
+
+// RequestStart does nothing
+func (NopObserver) RequestStart(m request.Method) {}
+
+// DialStart does nothing
+func (NopObserver) DialStart(ep Endpoint) {}
+
+// DialDone does nothing
+func (NopObserver) DialDone(ep Endpoint, err error) {}
+
+// TLSHandshakeStart does nothing
+func (NopObserver) TLSHandshakeStart(ep Endpoint) {}
+
+// TLSHandshakeDone does nothing
+func (NopObserver) TLSHandshakeDone(ep Endpoint, err error) {}
+
+// WroteRequest does nothing
+func (NopObserver) WroteRequest(ep Endpoint, err error) {}
+
+// GotFirstResponseByte does nothing
+func (NopObserver) GotFirstResponseByte(ep Endpoint) {}
+
+// AttemptDone does nothing
+func (NopObserver) AttemptDone(a *AttemptStats) {}
+
+// RequestDone does nothing
+func (NopObserver) RequestDone(r *RequestStats) {}
+
+type attemptKey struct{}
+
+// attempt tracks an attempt in progress, it is carried in the
+// context so that dials can record the handshake time
+type attempt struct {
+	AttemptStats
+	obs       Observer
+	start     time.Time
+	gotStatus time.Time
+}
+
+func newAttempt(ctx context.Context, obs Observer, m request.Method, ep Endpoint) (context.Context, *attempt) {
+	a := &attempt{
+		AttemptStats: AttemptStats{Method: m, Endpoint: ep},
+		obs:          obs,
+		start:        time.Now(),
+	}
+	return context.WithValue(ctx, attemptKey{}, a), a
+}
+
+func attemptFrom(ctx context.Context) (a *attempt) {
+	a, _ = ctx.Value(attemptKey{}).(*attempt)
+	return
+}
+
+// done completes the stats and reports them
+func (a *attempt) done(rs *response.Response, err error) {
+	now := time.Now()
+	a.Duration = now.Sub(a.start)
+	if !a.gotStatus.IsZero() {
+		a.Parse = now.Sub(a.gotStatus)
+	}
+	if rs != nil {
+		a.Code = rs.StatusCode
+		a.HasStatus = true
+	}
+	a.Err = err
+	a.obs.AttemptDone(&a.AttemptStats)
+}
+
+// countingConn counts the bytes of an attempt and reports the
+// first response byte
+type countingConn struct {
+	net.Conn
+	a *attempt
+}
+
+func (c *countingConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if n > 0 && c.a.BytesReceived == 0 {
+		c.a.FirstByte = time.Since(c.a.start)
+		c.a.obs.GotFirstResponseByte(c.a.Endpoint)
+	}
+	c.a.BytesReceived += int64(n)
+	return
+}
+
+func (c *countingConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.a.BytesSent += int64(n)
+	return
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+type recordingObserver struct {
+	mu       sync.Mutex
+	events   []string
+	attempts []AttemptStats
+	requests []RequestStats
+}
+
+func (o *recordingObserver) add(e string) {
+	o.mu.Lock()
+	o.events = append(o.events, e)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) RequestStart(m request.Method) { o.add("start " + m.String()) }
+func (o *recordingObserver) DialStart(ep Endpoint)         { o.add("dial") }
+func (o *recordingObserver) DialDone(ep Endpoint, err error) {
+	if err != nil {
+		o.add("dial error")
+		return
+	}
+	o.add("dialed")
+}
+func (o *recordingObserver) TLSHandshakeStart(ep Endpoint)           { o.add("tls") }
+func (o *recordingObserver) TLSHandshakeDone(ep Endpoint, err error) { o.add("tls done") }
+func (o *recordingObserver) WroteRequest(ep Endpoint, err error)     { o.add("wrote") }
+func (o *recordingObserver) GotFirstResponseByte(ep Endpoint)        { o.add("first byte") }
+func (o *recordingObserver) AttemptDone(a *AttemptStats) {
+	o.add("attempt")
+	o.mu.Lock()
+	o.attempts = append(o.attempts, *a)
+	o.mu.Unlock()
+}
+func (o *recordingObserver) RequestDone(r *RequestStats) {
+	o.add("done")
+	o.mu.Lock()
+	o.requests = append(o.requests, *r)
+	o.mu.Unlock()
+}
+
+func TestObserver(t *testing.T) {
+	ctx := context.Background()
+	s := newCheckServer(t)
+	o := &recordingObserver{}
+	c, e := NewClientWithOptions(WithEndpoint("tcp", s.l.Addr().String()), WithObserver(o))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	msg := "Subject: test\r\n\r\nbody\r\n"
+	if _, e = c.Check(ctx, strings.NewReader(msg)); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+
+	expected := "start CHECK,dial,dialed,wrote,first byte,attempt,done"
+	if got := strings.Join(o.events, ","); got != expected {
+		t.Errorf("Got %s want %s", got, expected)
+	}
+	a := o.attempts[0]
+	if a.Method != request.Check || a.Endpoint.Address != s.l.Addr().String() {
+		t.Errorf("Got %s %v want the CHECK attempt", a.Method, a.Endpoint)
+	}
+	if !a.HasStatus || a.Code != response.ExOK || a.Err != nil {
+		t.Errorf("Got %t %s %v want EX_OK", a.HasStatus, a.Code, a.Err)
+	}
+	if a.BytesSent <= int64(len(msg)) || a.BytesReceived != int64(len(checkReply)) {
+		t.Errorf("Got %d/%d bytes want more than %d/%d", a.BytesSent, a.BytesReceived, len(msg), len(checkReply))
+	}
+	if a.Connect <= 0 || a.FirstByte <= 0 || a.Duration < a.FirstByte || a.TLSHandshake != 0 {
+		t.Errorf("Got %+v want the phase timings", a)
+	}
+	r := o.requests[0]
+	if r.Attempts != 1 || r.Code != response.ExOK || r.Duration < a.Duration {
+		t.Errorf("Got %+v want one attempt", r)
+	}
+
+	c.SetObserver(nil)
+	if _, e = c.Check(ctx, strings.NewReader(msg)); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if len(o.requests) != 1 {
+		t.Errorf("Got %d want %d requests observed", len(o.requests), 1)
+	}
+}
+
+func TestObserverTLS(t *testing.T) {
+	ctx := context.Background()
+	s := newTLSServer(t, false)
+	o := &recordingObserver{}
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithTLS(),
+		WithRootCA(testCA),
+		WithServerName("localhost"),
+		WithTLSVersion(tls.VersionTLS12, 0),
+		WithObserver(o),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n")); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	expected := "start CHECK,dial,tls,tls done,dialed,wrote,first byte,attempt,done"
+	if got := strings.Join(o.events, ","); got != expected {
+		t.Errorf("Got %s want %s", got, expected)
+	}
+	if a := o.attempts[0]; a.TLSHandshake <= 0 || a.Connect < a.TLSHandshake {
+		t.Errorf("Got %v/%v want the handshake time", a.TLSHandshake, a.Connect)
+	}
+}
+
+func TestObserverRetry(t *testing.T) {
+	ctx := context.Background()
+	s := newSeqServer(t, tempFailReply, checkReply)
+	o := &recordingObserver{}
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}),
+		WithObserver(o),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n")); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if len(o.attempts) != 2 {
+		t.Fatalf("Got %d want %d attempts", len(o.attempts), 2)
+	}
+	var se *ServerError
+	if a := o.attempts[0]; a.Code != response.ExTempFail || !errors.As(a.Err, &se) {
+		t.Errorf("Got %s %v want EX_TEMPFAIL", a.Code, a.Err)
+	}
+	r := o.requests[0]
+	if r.Attempts != 2 || r.Code != response.ExOK || r.Err != nil {
+		t.Errorf("Got %+v want two attempts ending with EX_OK", r)
+	}
+}
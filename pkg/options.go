@@ -0,0 +1,397 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+const (
+	invalidOptionErr = "Invalid value for %s: %v"
+)
+
+// An Option configures a Client created by NewClientWithOptions
+type Option func(o *options) error
+
+// options collects the Option values before the Client is created
+type options struct {
+	settings
+	endpoints []Endpoint
+	pool      *PoolConfig
+}
+
+// RequestOptions overrides the client settings for a single request
+type RequestOptions struct {
+	// User overrides the user when not empty
+	User string
+	// RawBody overrides returning the raw body when not nil
+	RawBody *bool
+	// Verbatim sends an uncompressed body without the line ending
+	// otherwise added after it, spamd sees the exact message and a
+	// PROCESS raw body is returned without that line ending
+	Verbatim bool
+	// Timeout overrides the cmd timeout when greater than zero
+	Timeout time.Duration
+	// MsgType is the message type of a TELL request
+	MsgType request.MsgType
+	// Action is the action of a TELL request
+	Action request.TellAction
+}
+
+// Bool returns a pointer to v, for use with RequestOptions
+func Bool(v bool) *bool {
+	return &v
+}
+
+// NewClientWithOptions returns a new Spamd-client configured by opts,
+// the default unix socket is used when no endpoint is given.
+func NewClientWithOptions(opts ...Option) (c *Client, err error) {
+	o := &options{settings: newClient().settings}
+	for _, opt := range opts {
+		if err = opt(o); err != nil {
+			return
+		}
+	}
+
+	if len(o.endpoints) == 0 {
+		o.endpoints = []Endpoint{{Network: "unix", Address: defaultSock}}
+	}
+
+	c = newClient()
+	c.settings = o.settings
+	if err = c.setEndpoints(o.endpoints); err != nil {
+		c = nil
+		return
+	}
+	if o.pool != nil {
+		c.EnablePool(*o.pool)
+	}
+	return
+}
+
+// WithEndpoint adds a spamd server to connect to
+func WithEndpoint(network, address string) Option {
+	return WithEndpoints(Endpoint{Network: network, Address: address})
+}
+
+// WithEndpoints adds spamd servers to connect to
+func WithEndpoints(endpoints ...Endpoint) Option {
+	return func(o *options) (err error) {
+		o.endpoints = append(o.endpoints, endpoints...)
+		return
+	}
+}
+
+// WithBalancer sets the endpoint selection strategy
+func WithBalancer(b Balancer) Option {
+	return func(o *options) (err error) {
+		if b < RoundRobin || b > Ordered {
+			err = fmt.Errorf(invalidOptionErr, "balancer", int(b))
+			return
+		}
+		o.balancer = b
+		return
+	}
+}
+
+// WithEjectCooldown sets the period a failing endpoint is
+// ejected from selection
+func WithEjectCooldown(d time.Duration) Option {
+	return func(o *options) (err error) {
+		if d < 0 {
+			err = fmt.Errorf(invalidOptionErr, "eject cooldown", d)
+			return
+		}
+		o.ejectCooldown = d
+		return
+	}
+}
+
+// WithObserver sets the Observer called at each phase of a request
+func WithObserver(obs Observer) Option {
+	return func(o *options) (err error) {
+		if obs != nil {
+			o.observer = obs
+		}
+		return
+	}
+}
+
+// WithLogger sets the Logger used to log dials, retries,
+// failovers, protocol anomalies and slow or failed requests
+func WithLogger(l Logger) Option {
+	return func(o *options) (err error) {
+		if l != nil {
+			o.logger = l
+		}
+		return
+	}
+}
+
+// WithSlowThreshold sets the duration above which a request is
+// logged as slow, zero disables it
+func WithSlowThreshold(d time.Duration) Option {
+	return func(o *options) (err error) {
+		if d < 0 {
+			err = fmt.Errorf(invalidOptionErr, "slow threshold", d)
+			return
+		}
+		o.slowThreshold = d
+		return
+	}
+}
+
+// WithPool enables a pool of pre-dialed connections for each endpoint
+func WithPool(conf PoolConfig) Option {
+	return func(o *options) (err error) {
+		if conf.MaxIdle < 0 || conf.MaxOpen < 0 {
+			err = fmt.Errorf(invalidOptionErr, "pool", conf)
+			return
+		}
+		o.pool = &conf
+		return
+	}
+}
+
+// WithRetryPolicy sets the policy used to retry failed requests
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *options) (err error) {
+		if err = p.validate(); err != nil {
+			return
+		}
+		o.retry = p
+		return
+	}
+}
+
+// WithUser sets the user
+func WithUser(u string) Option {
+	return func(o *options) (err error) {
+		o.user = u
+		return
+	}
+}
+
+// WithCompression enables compression
+func WithCompression() Option {
+	return func(o *options) (err error) {
+		o.useCompression = true
+		return
+	}
+}
+
+// WithCompressionLevel sets the zlib compression level
+func WithCompressionLevel(l int) Option {
+	return func(o *options) (err error) {
+		if l < zlib.HuffmanOnly || l > zlib.BestCompression {
+			err = fmt.Errorf(invalidOptionErr, "compression level", l)
+			return
+		}
+		o.compressionLevel = l
+		return
+	}
+}
+
+// WithCompressionMinSize sets the message size in bytes below
+// which compression is skipped
+func WithCompressionMinSize(n int64) Option {
+	return func(o *options) (err error) {
+		if n < 0 {
+			err = fmt.Errorf(invalidOptionErr, "compression min size", n)
+			return
+		}
+		o.compressionMinSize = n
+		return
+	}
+}
+
+// WithTLS enables TLS
+func WithTLS() Option {
+	return func(o *options) (err error) {
+		o.useTLS = true
+		return
+	}
+}
+
+// WithRootCA sets the path to the RootCA file, the file is
+// loaded and an error returned if it has no valid certificate
+func WithRootCA(p string) Option {
+	return func(o *options) (err error) {
+		var pool *x509.CertPool
+		if pool, err = loadRootCA(p); err != nil {
+			return
+		}
+		o.rootCA = p
+		o.rootCAs = pool
+		return
+	}
+}
+
+// WithClientCert sets the certificate and key presented to spamd
+func WithClientCert(certFile, keyFile string) Option {
+	return func(o *options) (err error) {
+		o.certificates, err = loadClientCert(certFile, keyFile)
+		return
+	}
+}
+
+// WithTLSVersion sets the minimum and maximum TLS versions,
+// zero leaves the crypto/tls default in place
+func WithTLSVersion(min, max uint16) Option {
+	return func(o *options) (err error) {
+		if err = checkTLSVersions(min, max); err != nil {
+			return
+		}
+		o.minTLSVersion = min
+		o.maxTLSVersion = max
+		return
+	}
+}
+
+// WithServerName sets the name used to verify the server certificate
+func WithServerName(n string) Option {
+	return func(o *options) (err error) {
+		o.serverName = n
+		return
+	}
+}
+
+// WithPinnedKeys pins the server certificate to the base64 encoded
+// SHA-256 hashes of its SubjectPublicKeyInfo
+func WithPinnedKeys(pins ...string) Option {
+	return func(o *options) (err error) {
+		o.pins, err = parsePins(pins)
+		return
+	}
+}
+
+// WithTLSConfig sets the tls.Config used as the base of the TLS settings
+func WithTLSConfig(conf *tls.Config) Option {
+	return func(o *options) (err error) {
+		if conf != nil {
+			o.tlsConf = conf.Clone()
+		}
+		return
+	}
+}
+
+// WithInsecureSkipVerify disables verification of the server certificate
+func WithInsecureSkipVerify() Option {
+	return func(o *options) (err error) {
+		o.insecureSkipVerify = true
+		return
+	}
+}
+
+// WithRawBody enables returning the raw body
+func WithRawBody() Option {
+	return func(o *options) (err error) {
+		o.returnRawBody = true
+		return
+	}
+}
+
+// WithConnTimeout sets the connection timeout, 0 disables it
+func WithConnTimeout(t time.Duration) Option {
+	return func(o *options) (err error) {
+		if t < 0 {
+			err = fmt.Errorf(invalidOptionErr, "conn timeout", t)
+			return
+		}
+		o.connTimeout = t
+		return
+	}
+}
+
+// WithCmdTimeout sets the cmd timeout, 0 disables it
+func WithCmdTimeout(t time.Duration) Option {
+	return func(o *options) (err error) {
+		if t < 0 {
+			err = fmt.Errorf(invalidOptionErr, "cmd timeout", t)
+			return
+		}
+		o.cmdTimeout = t
+		return
+	}
+}
+
+// WithConnRetries sets the number of times connection is retried
+func WithConnRetries(n int) Option {
+	return func(o *options) (err error) {
+		if n < 0 {
+			err = fmt.Errorf(invalidOptionErr, "conn retries", n)
+			return
+		}
+		o.connRetries = n
+		return
+	}
+}
+
+// WithConnSleep sets the connection retry sleep duration
+func WithConnSleep(t time.Duration) Option {
+	return func(o *options) (err error) {
+		if t <= 0 {
+			err = fmt.Errorf(invalidOptionErr, "conn sleep", t)
+			return
+		}
+		o.connSleep = t
+		return
+	}
+}
+
+// WithoutSpooling disables spooling of messages of unknown length
+func WithoutSpooling() Option {
+	return func(o *options) (err error) {
+		o.useSpool = false
+		return
+	}
+}
+
+// WithSpoolThreshold sets the size in bytes above which messages
+// of unknown length are spooled to a temp file instead of memory
+func WithSpoolThreshold(n int64) Option {
+	return func(o *options) (err error) {
+		if n < 0 {
+			err = fmt.Errorf(invalidOptionErr, "spool threshold", n)
+			return
+		}
+		o.spoolThreshold = n
+		return
+	}
+}
+
+// WithSpoolDir sets the directory used for spool temp files
+func WithSpoolDir(d string) Option {
+	return func(o *options) (err error) {
+		o.spoolDir = d
+		return
+	}
+}
+
+// Do sends a request using method m, the overrides in o apply to
+// this request only and o may be nil.
+func (c *Client) Do(ctx context.Context, m request.Method, r io.Reader, o *RequestOptions) (rs *response.Response, err error) {
+	a := request.NoAction
+	l := request.NoneType
+	if m == request.Tell {
+		if o == nil || o.MsgType < request.Ham || o.MsgType > request.Spam {
+			err = ErrInvalidLearnType
+			return
+		}
+		a, l = o.Action, o.MsgType
+	}
+	rs, err = c.cmd(ctx, m, a, l, r, o)
+	return
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+)
+
+func TestNewClientWithOptions(t *testing.T) {
+	c, e := NewClientWithOptions()
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if c.endpoints[0].Network != "unix" || c.endpoints[0].Address != defaultSock {
+		t.Errorf("Got %v want unix %s", c.endpoints[0], defaultSock)
+	}
+
+	c, e = NewClientWithOptions(
+		WithEndpoint("tcp", "127.1.1.1:4010"),
+		WithEndpoints(Endpoint{Network: "tcp", Address: "127.1.1.2:4010"}),
+		WithUser("exim"),
+		WithCompression(),
+		WithCompressionLevel(1),
+		WithTLS(),
+		WithRawBody(),
+		WithConnTimeout(2*time.Second),
+		WithCmdTimeout(3*time.Second),
+		WithConnRetries(2),
+		WithBalancer(LeastInFlight),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if len(c.endpoints) != 2 {
+		t.Errorf("Got %d want %d", len(c.endpoints), 2)
+	}
+	if c.address != "127.1.1.1:4010" {
+		t.Errorf("Got %q want %q", c.address, "127.1.1.1:4010")
+	}
+	if c.user != "exim" || !c.useCompression || c.compressionLevel != 1 || !c.useTLS || !c.returnRawBody {
+		t.Errorf("The options were not applied: %+v", c.settings)
+	}
+	if c.connTimeout != 2*time.Second || c.cmdTimeout != 3*time.Second || c.connRetries != 2 {
+		t.Errorf("The options were not applied: %+v", c.settings)
+	}
+	if c.balancer != LeastInFlight {
+		t.Errorf("Got %q want %q", c.balancer, LeastInFlight)
+	}
+	if c.connSleep != defaultSleep || c.spoolThreshold != defaultSpoolThreshold {
+		t.Errorf("The defaults should be kept: %+v", c.settings)
+	}
+}
+
+func TestDisabledTimeouts(t *testing.T) {
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", "127.1.1.1:4010"),
+		WithConnTimeout(0),
+		WithCmdTimeout(0),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if c.connTimeout != 0 || c.cmdTimeout != 0 {
+		t.Errorf("Got %s, %s want 0s, 0s", c.connTimeout, c.cmdTimeout)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	opts := []Option{
+		WithCompressionLevel(20),
+		WithCompressionMinSize(-1),
+		WithConnTimeout(-1),
+		WithCmdTimeout(-1),
+		WithConnRetries(-1),
+		WithConnSleep(0),
+		WithSpoolThreshold(-1),
+		WithEjectCooldown(-1),
+		WithBalancer(Balancer(20)),
+		WithPool(PoolConfig{MaxIdle: -1}),
+		WithRetryPolicy(RetryPolicy{Jitter: 2}),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: -1}),
+	}
+	for _, opt := range opts {
+		c, e := NewClientWithOptions(WithEndpoint("tcp", "127.1.1.1:4010"), opt)
+		if e == nil {
+			t.Errorf("An error should be returned")
+		}
+		if c != nil {
+			t.Errorf("A client should not be returned")
+		}
+	}
+	if _, e := NewClientWithOptions(WithRootCA("../examples/ca.pem")); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	ctx := context.Background()
+	s := newCheckServer(t)
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithUser("exim"),
+		WithPool(PoolConfig{MaxIdle: 1}),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			o := &RequestOptions{User: fmt.Sprintf("user%d", i), RawBody: Bool(true), Timeout: time.Second}
+			if _, err := c.Do(ctx, request.Check, strings.NewReader("Subject: test\r\n\r\n"), o); err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.SetCmdTimeout(2 * time.Second)
+		c.EnableRawBody()
+		c.DisableRawBody()
+	}()
+	wg.Wait()
+
+	if _, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n")); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+
+	users := make(map[string]bool)
+	for _, rq := range s.Requests() {
+		users[rq.header.Get("User")] = true
+	}
+	if len(users) != 11 || !users["exim"] || !users["user0"] {
+		t.Errorf("Got %v want exim and user0 to user9", users)
+	}
+	if c.user != "exim" {
+		t.Errorf("The client user should not change: %q", c.user)
+	}
+}
+
+func TestVerbatimRequest(t *testing.T) {
+	ctx := context.Background()
+	s := newCheckServer(t)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	msg := "Subject: test\r\n\r\nbody\r\n"
+	if _, e = c.Do(ctx, request.Check, strings.NewReader(msg), nil); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Do(ctx, request.Check, strings.NewReader(msg), &RequestOptions{Verbatim: true}); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+
+	rq := s.Requests()
+	if len(rq) != 2 {
+		t.Fatalf("Got %d want %d requests", len(rq), 2)
+	}
+	for i, want := range []string{msg + "\r\n", msg} {
+		if v := rq[i].header.Get("Content-length"); v != fmt.Sprint(len(want)) {
+			t.Errorf("Got %s want %d", v, len(want))
+		}
+		if string(rq[i].body)+string(rq[i].trailer) != want {
+			t.Errorf("Got %q want %q", string(rq[i].body)+string(rq[i].trailer), want)
+		}
+	}
+}
+
+func TestDoTell(t *testing.T) {
+	c, e := NewClientWithOptions(WithEndpoint("tcp", "127.1.1.1:4010"))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	_, e = c.Do(context.Background(), request.Tell, strings.NewReader(""), nil)
+	if e == nil || e.Error() != invalidLearnTypeErr {
+		t.Errorf("Got %v want %s", e, invalidLearnTypeErr)
+	}
+}
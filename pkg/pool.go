@@ -0,0 +1,365 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolSize = 2
+	// spamd closes connections that send nothing for 30s
+	defaultIdleTimeout = 20 * time.Second
+	poolClosedErr      = "The connection pool is closed"
+)
+
+// PoolConfig configures the pool of pre-dialed connections.
+//
+// spamd serves a single request per connection, so connections
+// are never returned to the pool, instead the pool is refilled
+// in the background as connections are used up. Every pre-dialed
+// connection occupies a spamd child process so MaxIdle should be
+// kept well below the spamd --max-children setting.
+type PoolConfig struct {
+	// MaxIdle is the number of pre-dialed connections kept ready
+	MaxIdle int
+	// MaxOpen limits the number of open connections, idle and
+	// in use, zero means no limit
+	MaxOpen int
+	// IdleTimeout is the time a pre-dialed connection may wait
+	// before it is discarded, it should be kept below the spamd
+	// --timeout-tcp setting. Zero uses a default of 20s and a
+	// negative value means no limit
+	IdleTimeout time.Duration
+}
+
+// PoolStats represents the connection pool statistics
+type PoolStats struct {
+	// Open is the number of open connections
+	Open int
+	// Idle is the number of pre-dialed connections ready for use
+	Idle int
+	// InUse is the number of connections in use
+	InUse int
+	// Hits is the number of requests served by a pre-dialed connection
+	Hits int64
+	// Misses is the number of requests that had to dial
+	Misses int64
+	// Dials is the number of connections dialed
+	Dials int64
+	// DialErrors is the number of failed dials
+	DialErrors int64
+	// Expired is the number of pre-dialed connections discarded
+	// after the idle timeout
+	Expired int64
+	// WaitCount is the number of requests that waited for MaxOpen
+	WaitCount int64
+	// WaitDuration is the total time spent waiting for MaxOpen
+	WaitDuration time.Duration
+}
+
+type idleConn struct {
+	conn net.Conn
+	t    time.Time
+}
+
+type pool struct {
+	conf    PoolConfig
+	dialFn  func(ctx context.Context) (net.Conn, error)
+	ctx     context.Context
+	cancel  context.CancelFunc
+	sem     chan struct{}
+	refill  chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	idle    []idleConn
+	closed  bool
+	stats   PoolStats
+	dialing int
+}
+
+func newPool(conf PoolConfig, dialFn func(ctx context.Context) (net.Conn, error)) (p *pool) {
+	if conf.MaxIdle <= 0 {
+		conf.MaxIdle = defaultPoolSize
+	}
+	if conf.MaxOpen > 0 && conf.MaxIdle > conf.MaxOpen {
+		conf.MaxIdle = conf.MaxOpen
+	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = defaultIdleTimeout
+	}
+
+	p = &pool{
+		conf:   conf,
+		dialFn: dialFn,
+		refill: make(chan struct{}, 1),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if conf.MaxOpen > 0 {
+		p.sem = make(chan struct{}, conf.MaxOpen)
+	}
+
+	p.wg.Add(1)
+	go p.run()
+	p.signal()
+	return
+}
+
+// get returns a pre-dialed connection, dialing a new one
+// when none is available or fresh is set
+func (p *pool) get(ctx context.Context, fresh bool) (conn net.Conn, err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		err = fmt.Errorf(poolClosedErr)
+		return
+	}
+
+	now := time.Now()
+	for !fresh && len(p.idle) > 0 {
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(ic, now) {
+			p.stats.Expired++
+			p.discard(ic.conn)
+			continue
+		}
+		p.stats.Hits++
+		p.mu.Unlock()
+		p.signal()
+		conn = &poolConn{Conn: ic.conn, p: p, reused: true}
+		return
+	}
+	p.stats.Misses++
+	p.mu.Unlock()
+	p.signal()
+
+	if err = p.acquire(ctx); err != nil {
+		return
+	}
+
+	if conn, err = p.dial(ctx); err != nil {
+		p.release()
+		return
+	}
+
+	conn = &poolConn{Conn: conn, p: p}
+	return
+}
+
+// Stats returns the pool statistics
+func (p *pool) Stats() (s PoolStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s = p.stats
+	s.Idle = len(p.idle)
+	s.InUse = s.Open - s.Idle
+	return
+}
+
+// Close closes the idle connections and stops the refill
+func (p *pool) Close() (err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.cancel()
+	for _, ic := range p.idle {
+		p.discard(ic.conn)
+	}
+	p.idle = nil
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return
+}
+
+func (p *pool) run() {
+	var tick <-chan time.Time
+
+	defer p.wg.Done()
+
+	if p.conf.IdleTimeout > 0 {
+		t := time.NewTicker(p.conf.IdleTimeout / 2)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.refill:
+			p.fill()
+		case <-tick:
+			p.reap()
+			p.fill()
+		}
+	}
+}
+
+// fill dials connections until MaxIdle are ready, it stops
+// at the first dial error and waits for the next signal
+func (p *pool) fill() {
+	for {
+		p.mu.Lock()
+		if p.closed || len(p.idle) >= p.conf.MaxIdle {
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		if !p.tryAcquire() {
+			return
+		}
+
+		conn, err := p.dial(p.ctx)
+		if err != nil {
+			p.release()
+			return
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.discard(conn)
+			p.mu.Unlock()
+			return
+		}
+		p.idle = append(p.idle, idleConn{conn: conn, t: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+// reap discards the idle connections that have expired
+func (p *pool) reap() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	idle := p.idle[:0]
+	for _, ic := range p.idle {
+		if p.expired(ic, now) {
+			p.stats.Expired++
+			p.discard(ic.conn)
+			continue
+		}
+		idle = append(idle, ic)
+	}
+	p.idle = idle
+}
+
+func (p *pool) dial(ctx context.Context) (conn net.Conn, err error) {
+	conn, err = p.dialFn(ctx)
+
+	p.mu.Lock()
+	p.stats.Dials++
+	if err != nil {
+		p.stats.DialErrors++
+	} else {
+		p.stats.Open++
+	}
+	p.mu.Unlock()
+	return
+}
+
+// discard closes an idle connection, p.mu must be held
+func (p *pool) discard(conn net.Conn) {
+	conn.Close()
+	p.stats.Open--
+	p.release()
+}
+
+func (p *pool) expired(ic idleConn, now time.Time) bool {
+	return p.conf.IdleTimeout > 0 && now.Sub(ic.t) > p.conf.IdleTimeout
+}
+
+func (p *pool) signal() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pool) acquire(ctx context.Context) (err error) {
+	if p.sem == nil {
+		return
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+		return
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.mu.Lock()
+	p.stats.WaitCount++
+	p.stats.WaitDuration += time.Since(start)
+	p.mu.Unlock()
+	return
+}
+
+func (p *pool) tryAcquire() (b bool) {
+	if p.sem == nil {
+		b = true
+		return
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+		b = true
+	default:
+	}
+	return
+}
+
+func (p *pool) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+// poolConn is a connection handed out by the pool, closing it
+// frees its slot and triggers a refill
+type poolConn struct {
+	net.Conn
+	p *pool
+	// reused is set when the connection was pre-dialed
+	reused bool
+	once   sync.Once
+}
+
+func (pc *poolConn) Close() (err error) {
+	err = pc.Conn.Close()
+	pc.once.Do(func() {
+		pc.p.mu.Lock()
+		pc.p.stats.Open--
+		pc.p.mu.Unlock()
+		pc.p.release()
+		pc.p.signal()
+	})
+	return
+}
+
+func (pc *poolConn) CloseWrite() (err error) {
+	if v, ok := pc.Conn.(interface{ CloseWrite() error }); ok {
+		err = v.CloseWrite()
+	}
+	return
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type pingServer struct {
+	l        net.Listener
+	accepted int64
+}
+
+func newPingServer(t *testing.T) (s *pingServer) {
+	s = newReplyServer(t, "SPAMD/1.5 0 PONG\r\n")
+	return
+}
+
+func newReplyServer(t *testing.T, reply string) (s *pingServer) {
+	s = &pingServer{}
+	s.l = newServer(t, func(conn net.Conn) {
+		atomic.AddInt64(&s.accepted, 1)
+		b := bufio.NewReader(conn)
+		if _, err := b.ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte(reply))
+	})
+	return
+}
+
+func (s *pingServer) Accepted() int64 {
+	return atomic.LoadInt64(&s.accepted)
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolPrefill(t *testing.T) {
+	ctx := context.Background()
+	s := newPingServer(t)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.EnablePool(PoolConfig{MaxIdle: 3})
+	defer c.Close()
+
+	waitFor(t, func() bool { return c.PoolStats().Idle == 3 })
+	waitFor(t, func() bool { return s.Accepted() == 3 })
+
+	ok, e := c.Ping(ctx)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if !ok {
+		t.Error("Ping failed")
+	}
+
+	waitFor(t, func() bool { return c.PoolStats().Idle == 3 })
+	st := c.PoolStats()
+	if st.Hits != 1 {
+		t.Errorf("Got %d want %d", st.Hits, 1)
+	}
+	if st.Misses != 0 {
+		t.Errorf("Got %d want %d", st.Misses, 0)
+	}
+	if st.Open != 3 {
+		t.Errorf("Got %d want %d", st.Open, 3)
+	}
+	if st.InUse != 0 {
+		t.Errorf("Got %d want %d", st.InUse, 0)
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	s := newPingServer(t)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.EnablePool(PoolConfig{MaxIdle: 1, MaxOpen: 1})
+	defer c.Close()
+
+	ctx := context.Background()
+	conn, e := c.dial(ctx, c.endpoints[0], &c.settings, false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, e = c.dial(tctx, c.endpoints[0], &c.settings, false); e != context.DeadlineExceeded {
+		t.Errorf("Got %v want %v", e, context.DeadlineExceeded)
+	}
+	if st := c.PoolStats(); st.WaitCount != 1 {
+		t.Errorf("Got %d want %d", st.WaitCount, 1)
+	}
+
+	conn.Close()
+	conn, e = c.dial(ctx, c.endpoints[0], &c.settings, false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	conn.Close()
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	s := newPingServer(t)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.EnablePool(PoolConfig{MaxIdle: 1, IdleTimeout: 20 * time.Millisecond})
+	defer c.Close()
+
+	waitFor(t, func() bool { return c.PoolStats().Expired > 0 })
+	waitFor(t, func() bool { return c.PoolStats().Idle == 1 })
+	waitFor(t, func() bool { return s.Accepted() >= 2 })
+}
+
+func TestPoolDefaultIdleTimeout(t *testing.T) {
+	s := newPingServer(t)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.EnablePool(PoolConfig{})
+	defer c.Close()
+
+	if d := c.endpoints[0].pool.conf.IdleTimeout; d != defaultIdleTimeout {
+		t.Errorf("Got %s want %s", d, defaultIdleTimeout)
+	}
+}
+
+func TestPoolStaleRedial(t *testing.T) {
+	var accepted int64
+
+	l := newServer(t, func(conn net.Conn) {
+		// the pre-dialed connection is closed like spamd
+		// does after --timeout-tcp
+		if atomic.AddInt64(&accepted, 1) == 1 {
+			return
+		}
+		b := bufio.NewReader(conn)
+		if _, err := b.ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte("SPAMD/1.5 0 PONG\r\n"))
+	})
+
+	c, e := NewClient("tcp", l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.EnablePool(PoolConfig{MaxIdle: 1})
+	defer c.Close()
+	waitFor(t, func() bool { return c.PoolStats().Idle == 1 })
+
+	ok, e := c.Ping(context.Background())
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if !ok {
+		t.Error("Ping failed")
+	}
+	if st := c.PoolStats(); st.Hits != 1 || st.Misses != 1 {
+		t.Errorf("Got %d/%d hits/misses want 1/1", st.Hits, st.Misses)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	s := newPingServer(t)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.EnablePool(PoolConfig{MaxIdle: 2})
+	waitFor(t, func() bool { return c.PoolStats().Idle == 2 })
+
+	p := c.endpoints[0].pool
+	if e = c.Close(); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if st := p.Stats(); st.Open != 0 || st.Idle != 0 {
+		t.Errorf("Got %d/%d open/idle want 0/0", st.Open, st.Idle)
+	}
+	if _, e = p.get(context.Background(), false); e == nil || e.Error() != poolClosedErr {
+		t.Errorf("Got %v want %s", e, poolClosedErr)
+	}
+}
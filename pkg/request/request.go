@@ -79,6 +79,18 @@ func (m Method) String() (s string) {
 	return
 }
 
+// ParseMethod returns the Method named s
+func ParseMethod(s string) (m Method, ok bool) {
+	for m = Check; m <= Tell; m++ {
+		if m.String() == s {
+			ok = true
+			return
+		}
+	}
+	m = -1
+	return
+}
+
 // UsesHeader checks if a method users a header
 func (m Method) UsesHeader(h header.Header) (b bool) {
 	switch m {
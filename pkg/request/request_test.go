@@ -80,6 +80,24 @@ func TestMethod(t *testing.T) {
 	}
 }
 
+func TestParseMethod(t *testing.T) {
+	for _, tt := range TestMethods {
+		m, ok := ParseMethod(tt.out)
+		if tt.out == "" {
+			if ok {
+				t.Errorf("ParseMethod(%q) should fail", tt.out)
+			}
+			continue
+		}
+		if !ok || m != tt.in {
+			t.Errorf("ParseMethod(%q) = %q, want %q", tt.out, m, tt.in)
+		}
+	}
+	if _, ok := ParseMethod("check"); ok {
+		t.Errorf("ParseMethod should be case sensitive")
+	}
+}
+
 func TestUsesHeader(t *testing.T) {
 	for _, tt := range TestUsesHeaders {
 		if b := tt.in.UsesHeader(tt.header); b != tt.out {
@@ -19,7 +19,7 @@ const (
 	// ExOK => EX_OK
 	ExOK StatusCode = 0
 	// ExUsage => EX_USAGE
-	ExUsage StatusCode = iota + 64
+	ExUsage StatusCode = iota + 63
 	// ExDataErr => EX_DATAERR
 	ExDataErr
 	// ExNoInput => EX_NOINPUT
@@ -138,6 +138,7 @@ func (s StatusCode) IsTemp() (r bool) {
 // A Response represents a server response from a Spamd server.
 type Response struct {
 	RequestMethod request.Method
+	Endpoint      string
 	StatusCode    StatusCode
 	StatusMsg     string
 	Version       string
@@ -147,7 +148,7 @@ type Response struct {
 	Headers       textproto.MIMEHeader
 	Msg           *Msg
 	Raw           []byte
-	Rules         []map[string]string
+	Rules         Rules
 }
 
 // NewResponse returns a new Response
@@ -62,3 +62,23 @@ func TestNewResponse(t *testing.T) {
 		t.Errorf("Got %q, want %q", r.RequestMethod, request.Check)
 	}
 }
+
+func TestStatusCodeValues(t *testing.T) {
+	tests := []struct {
+		c StatusCode
+		v int
+	}{
+		{ExOK, 0},
+		{ExUsage, 64},
+		{ExTempFail, 75},
+		{ExProtocol, 76},
+		{ExNoPerm, 77},
+		{ExConfig, 78},
+		{ExTimeout, 79},
+	}
+	for _, tt := range tests {
+		if int(tt.c) != tt.v {
+			t.Errorf("%s: got %d want %d", tt.c, int(tt.c), tt.v)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package response
+
+import (
+	"math"
+	"sort"
+)
+
+// A Rule represents a SpamAssassin rule that matched a message.
+type Rule struct {
+	Name        string
+	Score       float64
+	Description string
+	// HasScore is false when the server did not report the
+	// score, as is the case with SYMBOLS
+	HasScore bool
+}
+
+// Rules represents the rules that matched a message.
+type Rules []Rule
+
+// ByContribution returns a copy of the rules sorted by the absolute
+// value of their score, largest first, rules without a score are last
+func (r Rules) ByContribution() (s Rules) {
+	s = make(Rules, len(r))
+	copy(s, r)
+	sort.SliceStable(s, func(i, j int) bool {
+		if s[i].HasScore != s[j].HasScore {
+			return s[i].HasScore
+		}
+		return math.Abs(s[i].Score) > math.Abs(s[j].Score)
+	})
+	return
+}
+
+// Lookup returns the rule with the given name
+func (r Rules) Lookup(name string) (rule Rule, ok bool) {
+	for _, v := range r {
+		if v.Name == name {
+			rule = v
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// Positive returns the sum of the positive scores
+func (r Rules) Positive() (s float64) {
+	for _, v := range r {
+		if v.Score > 0 {
+			s += v.Score
+		}
+	}
+	return
+}
+
+// Negative returns the sum of the negative scores
+func (r Rules) Negative() (s float64) {
+	for _, v := range r {
+		if v.Score < 0 {
+			s += v.Score
+		}
+	}
+	return
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package response
+
+import "testing"
+
+var TestRules = Rules{
+	{Name: "SPF_PASS", Score: -0.1, HasScore: true},
+	{Name: "URIBL_BLACK", Score: 1.7, HasScore: true},
+	{Name: "HTML_MESSAGE"},
+	{Name: "RCVD_IN_DNSWL_HI", Score: -5.0, HasScore: true},
+	{Name: "BAYES_99", Score: 3.5, HasScore: true},
+}
+
+func TestByContribution(t *testing.T) {
+	expected := []string{
+		"RCVD_IN_DNSWL_HI",
+		"BAYES_99",
+		"URIBL_BLACK",
+		"SPF_PASS",
+		"HTML_MESSAGE",
+	}
+	s := TestRules.ByContribution()
+	for i, n := range expected {
+		if s[i].Name != n {
+			t.Errorf("Got %q want %q at %d", s[i].Name, n, i)
+		}
+	}
+	if TestRules[0].Name != "SPF_PASS" {
+		t.Errorf("ByContribution should not modify the receiver")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r, ok := TestRules.Lookup("BAYES_99")
+	if !ok {
+		t.Fatal("BAYES_99 should be found")
+	}
+	if r.Score != 3.5 {
+		t.Errorf("Got %v want %v", r.Score, 3.5)
+	}
+	if _, ok = TestRules.Lookup("MISSING"); ok {
+		t.Errorf("MISSING should not be found")
+	}
+}
+
+func TestContributions(t *testing.T) {
+	if s := TestRules.Positive(); s != 5.2 {
+		t.Errorf("Got %v want %v", s, 5.2)
+	}
+	if s := TestRules.Negative(); s != -5.1 {
+		t.Errorf("Got %v want %v", s, -5.1)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMultiplier = 2
+	invalidRetryErr   = "Invalid retry policy: %s"
+)
+
+// A RetryPolicy controls how requests that fail with a retryable
+// error are retried. Each attempt tries every endpoint before the
+// next backoff, the message is spooled so that it can be resent.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first,
+	// values below 2 disable retries
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts when greater than zero
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after each retry, 2 is used when zero
+	Multiplier float64
+	// Jitter randomizes each wait by up to this fraction of it
+	Jitter float64
+	// MaxElapsed bounds the total time of the request including
+	// retries when greater than zero
+	MaxElapsed time.Duration
+	// Retryable decides if a failed request is retried,
+	// IsRetryable is used when nil
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy returns a policy of three attempts with an
+// exponential backoff starting at 200ms
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 200 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     defaultMultiplier,
+		Jitter:         0.2,
+	}
+}
+
+// IsRetryable returns true when a request that failed with err may
+// be retried: dial failures, connections reset or closed before the
+// response was read, timeouts and EX_TEMPFAIL or EX_TIMEOUT replies.
+func IsRetryable(err error) (b bool) {
+	switch {
+	case err == nil:
+	case IsTemporary(err):
+		b = true
+	case errors.Is(err, ErrNoResponse),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		b = true
+	}
+	return
+}
+
+func (p *RetryPolicy) validate() (err error) {
+	switch {
+	case p.MaxAttempts < 0:
+		err = fmt.Errorf(invalidRetryErr, "negative attempts")
+	case p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.MaxElapsed < 0:
+		err = fmt.Errorf(invalidRetryErr, "negative duration")
+	case p.Multiplier < 0:
+		err = fmt.Errorf(invalidRetryErr, "negative multiplier")
+	case p.Jitter < 0 || p.Jitter > 1:
+		err = fmt.Errorf(invalidRetryErr, "jitter must be between 0 and 1")
+	}
+	return
+}
+
+func (p *RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 1
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// backoff returns the wait before retry n, counting from zero
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	m := p.Multiplier
+	if m == 0 {
+		m = defaultMultiplier
+	}
+	d := float64(p.InitialBackoff) * math.Pow(m, float64(n))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// wait sleeps for d before a retry, false is returned when the
+// context is done or its deadline would pass before the wait is over
+func (p *RetryPolicy) wait(ctx context.Context, d time.Duration) bool {
+	if dl, ok := ctx.Deadline(); ok && time.Now().Add(d).After(dl) {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// SetRetryPolicy sets the policy used to retry failed requests
+func (c *Client) SetRetryPolicy(p RetryPolicy) (err error) {
+	if err = p.validate(); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.retry = p
+	return
+}
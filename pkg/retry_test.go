@@ -0,0 +1,225 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+const (
+	tempFailReply = "SPAMD/1.5 75 EX_TEMPFAIL\r\n"
+	checkReply    = "SPAMD/1.5 0 EX_OK\r\nSpam: False ; 1.0 / 5.0\r\n\r\n"
+)
+
+type seqServer struct {
+	l        net.Listener
+	replies  []string
+	mu       sync.Mutex
+	requests [][]byte
+}
+
+// newSeqServer answers the nth request with the nth reply,
+// the last reply is repeated
+func newSeqServer(t *testing.T, replies ...string) (s *seqServer) {
+	s = &seqServer{replies: replies}
+	s.l = newServer(t, func(conn net.Conn) {
+		b, _ := ioutil.ReadAll(conn)
+		s.mu.Lock()
+		n := len(s.requests)
+		s.requests = append(s.requests, b)
+		s.mu.Unlock()
+		if n >= len(s.replies) {
+			n = len(s.replies) - 1
+		}
+		conn.Write([]byte(s.replies[n]))
+	})
+	return
+}
+
+func (s *seqServer) Requests() (r [][]byte) {
+	s.mu.Lock()
+	r = s.requests
+	s.mu.Unlock()
+	return
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+	}
+	for n, d := range expected {
+		if b := p.backoff(n); b != d {
+			t.Errorf("Got %s want %s for retry %d", b, d, n)
+		}
+	}
+
+	p.Multiplier = 1
+	p.Jitter = 0.5
+	for n := 0; n < 20; n++ {
+		if b := p.backoff(n); b < 50*time.Millisecond || b > 150*time.Millisecond {
+			t.Errorf("Got %s want 50ms-150ms", b)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{ErrNoResponse, true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{&ServerError{Code: response.ExTempFail}, true},
+		{&ServerError{Code: response.ExNoPerm}, false},
+		{&ProtocolError{Line: "garbage"}, false},
+		{context.Canceled, false},
+	}
+	for _, tt := range tests {
+		if b := IsRetryable(tt.err); b != tt.retryable {
+			t.Errorf("IsRetryable(%v) = %t, want %t", tt.err, b, tt.retryable)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	msg := "Subject: test\r\n\r\nbody\r\n"
+	s := newSeqServer(t, tempFailReply, tempFailReply, checkReply)
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	// A reader that can only be read once has to be spooled
+	rs, e := c.Check(context.Background(), struct{ io.Reader }{strings.NewReader(msg)})
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if rs.StatusCode != response.ExOK {
+		t.Errorf("Got %q want %q", rs.StatusCode, response.ExOK)
+	}
+	requests := s.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("Got %d want %d", len(requests), 3)
+	}
+	for _, rq := range requests[1:] {
+		if !bytes.Equal(rq, requests[0]) {
+			t.Errorf("The retries should resend the message: %q", rq)
+		}
+	}
+	if !bytes.Contains(requests[2], []byte(msg)) {
+		t.Errorf("Got %q want the message", requests[2])
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	s := newSeqServer(t, tempFailReply)
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	_, e = c.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\n"))
+	if !errors.Is(e, response.ExTempFail) {
+		t.Errorf("Got %v want %s", e, response.ExTempFail)
+	}
+	if n := len(s.Requests()); n != 2 {
+		t.Errorf("Got %d want %d", n, 2)
+	}
+}
+
+func TestRetryHook(t *testing.T) {
+	s := newSeqServer(t, tempFailReply, checkReply)
+	var called int
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			Retryable: func(err error) bool {
+				called++
+				return false
+			},
+		}),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	_, e = c.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\n"))
+	if !errors.Is(e, response.ExTempFail) {
+		t.Errorf("Got %v want %s", e, response.ExTempFail)
+	}
+	if called != 1 || len(s.Requests()) != 1 {
+		t.Errorf("Got %d/%d want 1/1", called, len(s.Requests()))
+	}
+}
+
+func TestRetryMaxElapsed(t *testing.T) {
+	s := newSeqServer(t, tempFailReply, checkReply)
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Minute,
+			MaxElapsed:     time.Second,
+		}),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	start := time.Now()
+	_, e = c.Check(context.Background(), strings.NewReader("Subject: test\r\n\r\n"))
+	if !errors.Is(e, response.ExTempFail) {
+		t.Errorf("Got %v want %s", e, response.ExTempFail)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("The retry should not wait beyond the budget")
+	}
+	if n := len(s.Requests()); n != 1 {
+		t.Errorf("Got %d want %d", n, 1)
+	}
+}
+
+func TestRetryWithoutSpool(t *testing.T) {
+	s := newSeqServer(t, tempFailReply, checkReply)
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}),
+		WithoutSpooling(),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	// A buffer has a length but can not be rewound
+	_, e = c.Check(context.Background(), bytes.NewBufferString("Subject: test\r\n\r\n"))
+	if !errors.Is(e, response.ExTempFail) {
+		t.Errorf("Got %v want %s", e, response.ExTempFail)
+	}
+	if n := len(s.Requests()); n != 1 {
+		t.Errorf("Got %d want %d", n, 1)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bufio"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/header"
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+)
+
+const (
+	protoPrefix       = "SPAMC/"
+	invalidRequestErr = "Invalid request line: %s"
+	invalidMethodErr  = "Unsupported method: %s"
+	invalidVersionErr = "Unsupported protocol version: %s"
+	invalidLengthErr  = "Invalid Content-length: %s"
+	invalidCompress   = "Unsupported compression: %s"
+)
+
+// A Request represents a request received by the Server
+type Request struct {
+	Method request.Method
+	// Version is the protocol version sent by the client
+	Version string
+	Header  textproto.MIMEHeader
+	// User is the value of the User header
+	User string
+	// ContentLength is the length of the body as sent, -1 when
+	// the client did not send a Content-length
+	ContentLength int64
+	// Compressed is set when the body is zlib compressed, Body
+	// returns the decompressed message
+	Compressed bool
+	// Action and MsgType are set for TELL requests
+	Action  request.TellAction
+	MsgType request.MsgType
+	// Body is the message, it is empty for PING and SKIP
+	Body io.Reader
+	// RemoteAddr is the address of the client
+	RemoteAddr string
+	// TLS is set when the connection uses TLS
+	TLS *tls.ConnectionState
+
+	ctx context.Context
+	zr  io.ReadCloser
+}
+
+// Context returns the request context, it is cancelled when the
+// response has been sent or the server is closed
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
+// ReadRequest reads and parses a request from b, the body is
+// not read and is returned as r.Body
+func ReadRequest(b *bufio.Reader) (r *Request, err error) {
+	var line string
+	var ok bool
+
+	tp := textproto.NewReader(b)
+	if line, err = tp.ReadLine(); err != nil {
+		return
+	}
+	f := strings.Fields(line)
+	if len(f) != 2 || !strings.HasPrefix(f[1], protoPrefix) {
+		err = fmt.Errorf(invalidRequestErr, line)
+		return
+	}
+
+	r = &Request{
+		Version:       strings.TrimPrefix(f[1], protoPrefix),
+		ContentLength: -1,
+	}
+	if !strings.HasPrefix(r.Version, "1.") {
+		err = fmt.Errorf(invalidVersionErr, r.Version)
+		return
+	}
+	if r.Method, ok = request.ParseMethod(f[0]); !ok {
+		err = fmt.Errorf(invalidMethodErr, f[0])
+		return
+	}
+	if r.Header, err = tp.ReadMIMEHeader(); err != nil {
+		if err != io.EOF || r.Header == nil {
+			return
+		}
+		err = nil
+	}
+	r.User = r.Header.Get(header.User.String())
+
+	if v := r.Header.Get(header.ContentLength.String()); v != "" {
+		if r.ContentLength, err = strconv.ParseInt(v, 10, 64); err != nil || r.ContentLength < 0 {
+			err = fmt.Errorf(invalidLengthErr, v)
+			return
+		}
+	}
+
+	switch r.Method {
+	case request.Ping, request.Skip:
+		r.Body = strings.NewReader("")
+	default:
+		if r.ContentLength >= 0 {
+			r.Body = io.LimitReader(b, r.ContentLength)
+		} else {
+			r.Body = b
+		}
+	}
+
+	if v := r.Header.Get(header.Compress.String()); v != "" {
+		if !strings.EqualFold(v, "zlib") {
+			err = fmt.Errorf(invalidCompress, v)
+			return
+		}
+		r.Compressed = true
+		r.Body = &lazyZlib{r: r.Body, req: r}
+	}
+
+	if r.Method == request.Tell {
+		r.Action, r.MsgType = TellAction(r.Header)
+	}
+	return
+}
+
+// TellAction returns the action and message type requested
+// by the headers of a TELL request
+func TellAction(h textproto.MIMEHeader) (a request.TellAction, l request.MsgType) {
+	set := h.Get(header.Set.String())
+	remove := h.Get(header.Remove.String())
+	switch h.Get(header.MessageClass.String()) {
+	case request.Spam.String():
+		l = request.Spam
+	case request.Ham.String():
+		l = request.Ham
+	}
+	switch {
+	case strings.Contains(remove, "remote"):
+		a = request.RevokeAction
+	case strings.Contains(set, "remote"):
+		a = request.ReportAction
+	case set != "":
+		a = request.LearnAction
+	case remove != "":
+		a = request.ForgetAction
+	}
+	return
+}
+
+// lazyZlib defers creating the zlib reader to the first read, so
+// a handler that ignores the body does not block reading it
+type lazyZlib struct {
+	r   io.Reader
+	req *Request
+	err error
+}
+
+func (z *lazyZlib) Read(p []byte) (n int, err error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.req.zr == nil {
+		if z.req.zr, err = zlib.NewReader(z.r); err != nil {
+			z.err = err
+			return
+		}
+	}
+	return z.req.zr.Read(p)
+}
+
+func (r *Request) closeBody() {
+	if r.zr != nil {
+		r.zr.Close()
+	}
+}
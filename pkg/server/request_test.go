@@ -0,0 +1,118 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+)
+
+const testMsg = "From: sender@example.com\r\nSubject: test\r\n\r\nbody\r\n"
+
+func bufioReader(s string) *bufio.Reader {
+	return bufio.NewReader(strings.NewReader(s))
+}
+
+func TestReadRequest(t *testing.T) {
+	s := fmt.Sprintf("CHECK SPAMC/1.5\r\nUser: exim\r\nContent-length: %d\r\n\r\n%s\r\n", len(testMsg), testMsg)
+	r, e := ReadRequest(bufioReader(s))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if r.Method != request.Check || r.Version != "1.5" || r.User != "exim" {
+		t.Errorf("Got %q %q %q want CHECK 1.5 exim", r.Method, r.Version, r.User)
+	}
+	if r.ContentLength != int64(len(testMsg)) {
+		t.Errorf("Got %d want %d", r.ContentLength, len(testMsg))
+	}
+	b, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if string(b) != testMsg {
+		t.Errorf("Got %q want %q", b, testMsg)
+	}
+
+	r, e = ReadRequest(bufioReader("PING SPAMC/1.2\r\n\r\n"))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if r.Method != request.Ping || r.ContentLength != -1 {
+		t.Errorf("Got %q %d want PING -1", r.Method, r.ContentLength)
+	}
+}
+
+func TestReadRequestCompressed(t *testing.T) {
+	var z bytes.Buffer
+
+	w := zlib.NewWriter(&z)
+	w.Write([]byte(testMsg))
+	w.Close()
+	s := fmt.Sprintf("PROCESS SPAMC/1.5\r\nCompress: zlib\r\nContent-length: %d\r\n\r\n%s", z.Len(), z.String())
+	r, e := ReadRequest(bufioReader(s))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer r.closeBody()
+	if !r.Compressed {
+		t.Errorf("Got %t want %t", r.Compressed, true)
+	}
+	b, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if string(b) != testMsg {
+		t.Errorf("Got %q want %q", b, testMsg)
+	}
+}
+
+func TestReadRequestTell(t *testing.T) {
+	tests := []struct {
+		headers string
+		a       request.TellAction
+		l       request.MsgType
+	}{
+		{"Message-class: spam\r\nSet: local\r\n", request.LearnAction, request.Spam},
+		{"Message-class: ham\r\nRemove: local\r\n", request.ForgetAction, request.Ham},
+		{"Message-class: spam\r\nSet: local, remote\r\n", request.ReportAction, request.Spam},
+		{"Message-class: ham\r\nSet: local\r\nRemove: remote\r\n", request.RevokeAction, request.Ham},
+	}
+	for _, tt := range tests {
+		s := fmt.Sprintf("TELL SPAMC/1.5\r\n%sContent-length: %d\r\n\r\n%s", tt.headers, len(testMsg), testMsg)
+		r, e := ReadRequest(bufioReader(s))
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if r.Action != tt.a || r.MsgType != tt.l {
+			t.Errorf("Got %v %v want %v %v", r.Action, r.MsgType, tt.a, tt.l)
+		}
+	}
+}
+
+func TestReadRequestInvalid(t *testing.T) {
+	tests := []string{
+		"FOO SPAMC/1.5\r\n\r\n",
+		"CHECK HTTP/1.1\r\n\r\n",
+		"CHECK SPAMC/2.0\r\n\r\n",
+		"CHECK\r\n\r\n",
+		"CHECK SPAMC/1.5\r\nContent-length: x\r\n\r\n",
+		"CHECK SPAMC/1.5\r\nContent-length: -1\r\n\r\n",
+		"CHECK SPAMC/1.5\r\nCompress: gzip\r\n\r\n",
+		"",
+	}
+	for _, tt := range tests {
+		if _, e := ReadRequest(bufioReader(tt)); e == nil {
+			t.Errorf("An error should be returned for %q", tt)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/header"
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+const (
+	// Version is the protocol version sent in responses
+	Version            = "1.5"
+	pongMsg            = "PONG"
+	noDescription      = "No description available."
+	reportHeader       = "Spam detection software, running on the system \"%s\",\r\nhas identified this incoming email as possible spam.\r\n\r\n"
+	reportDetails      = "Content analysis details:   (%.1f points, %.1f required)\r\n\r\n"
+	reportTableHeading = " pts rule name              description\r\n---- ---------------------- --------------------------------------------------\r\n"
+)
+
+// A ResponseWriter is used by a Handler to construct the response.
+//
+// The body is buffered so that the Content-length can be sent
+// before it. Only the status line is sent when the status is not
+// EX_OK, nothing is sent for SKIP requests.
+type ResponseWriter interface {
+	// Header returns the headers sent with the response
+	Header() textproto.MIMEHeader
+	// WriteStatus sets the status, EX_OK is used if it is not called
+	WriteStatus(code response.StatusCode)
+	// Write appends to the response body
+	Write(p []byte) (int, error)
+}
+
+type responseWriter struct {
+	method request.Method
+	header textproto.MIMEHeader
+	code   response.StatusCode
+	body   bytes.Buffer
+}
+
+func newResponseWriter(m request.Method) *responseWriter {
+	return &responseWriter{
+		method: m,
+		header: make(textproto.MIMEHeader),
+	}
+}
+
+func (w *responseWriter) Header() textproto.MIMEHeader {
+	return w.header
+}
+
+func (w *responseWriter) WriteStatus(code response.StatusCode) {
+	w.code = code
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// flush writes the response to out
+func (w *responseWriter) flush(out io.Writer) (err error) {
+	var b bytes.Buffer
+
+	switch {
+	case w.method == request.Skip:
+		return
+	case w.method == request.Ping && w.code == response.ExOK:
+		writeStatus(&b, w.code, pongMsg)
+	case w.code != response.ExOK:
+		writeStatus(&b, w.code, "")
+	default:
+		writeStatus(&b, w.code, "")
+		for k, vs := range w.header {
+			if k == textproto.CanonicalMIMEHeaderKey(header.ContentLength.String()) {
+				continue
+			}
+			for _, v := range vs {
+				fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+			}
+		}
+		fmt.Fprintf(&b, "%s: %d\r\n\r\n", header.ContentLength, w.body.Len())
+		b.Write(w.body.Bytes())
+	}
+	_, err = out.Write(b.Bytes())
+	return
+}
+
+func writeStatus(w io.Writer, code response.StatusCode, msg string) {
+	if msg == "" {
+		msg = code.String()
+	}
+	fmt.Fprintf(w, "SPAMD/%s %d %s\r\n", Version, int(code), msg)
+}
+
+// SpamHeader returns the value of the Spam header
+func SpamHeader(isSpam bool, score, threshold float64) string {
+	flag := "False"
+	if isSpam {
+		flag = "True"
+	}
+	return fmt.Sprintf("%s ; %.1f / %.1f", flag, score, threshold)
+}
+
+// WriteSymbols writes the SYMBOLS body listing the rule names
+func WriteSymbols(w io.Writer, rules response.Rules) (err error) {
+	names := make([]string, len(rules))
+	for i, r := range rules {
+		names[i] = r.Name
+	}
+	_, err = io.WriteString(w, strings.Join(names, ","))
+	return
+}
+
+// WriteReport writes a REPORT body in the format of the default
+// SpamAssassin report template, hostname is named in the preamble
+func WriteReport(w io.Writer, hostname string, score, threshold float64, rules response.Rules) (err error) {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, reportHeader, hostname)
+	fmt.Fprintf(&b, reportDetails, score, threshold)
+	b.WriteString(reportTableHeading)
+	for _, r := range rules {
+		d := r.Description
+		if d == "" {
+			d = noDescription
+		}
+		fmt.Fprintf(&b, "%4.1f %-22s %s\r\n", r.Score, r.Name, d)
+	}
+	_, err = w.Write(b.Bytes())
+	return
+}
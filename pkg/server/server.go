@@ -0,0 +1,331 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package server implements the server side of the spamd protocol
+spamd-client - Golang Spamd SpamAssassin Client
+*/
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+const (
+	maxAcceptSleep = time.Second
+	minAcceptSleep = 5 * time.Millisecond
+)
+
+// ErrServerClosed is returned by Serve after Close or Shutdown
+var ErrServerClosed = errors.New("server: Server closed")
+
+// A Handler responds to a spamd request.
+//
+// The response is sent once ServeSPAMD returns, the request body
+// must not be used after that. A handler that panics is answered
+// with EX_SOFTWARE.
+type Handler interface {
+	ServeSPAMD(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc allows the use of a function as a Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeSPAMD calls f(w, r)
+func (f HandlerFunc) ServeSPAMD(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// A Server serves spamd protocol requests, each connection
+// carries a single request as with spamd.
+type Server struct {
+	// Handler is called for each request, EX_UNAVAILABLE is
+	// returned when it is nil
+	Handler Handler
+	// TLSConfig is used by ServeTLS and ListenAndServeTLS
+	TLSConfig *tls.Config
+	// ReadTimeout bounds reading the request including the body
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing the response
+	WriteTimeout time.Duration
+	// ErrorLog logs protocol errors and panics, the standard
+	// logger is used when nil
+	ErrorLog *log.Logger
+
+	mu        sync.Mutex
+	closed    bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+}
+
+// ListenAndServe listens on the network address and serves requests
+func (s *Server) ListenAndServe(network, address string) (err error) {
+	var l net.Listener
+
+	if l, err = net.Listen(network, address); err != nil {
+		return
+	}
+	err = s.Serve(l)
+	return
+}
+
+// ListenAndServeTLS listens on the network address and serves
+// requests over TLS, certFile and keyFile may be empty when
+// TLSConfig has certificates
+func (s *Server) ListenAndServeTLS(network, address, certFile, keyFile string) (err error) {
+	var l net.Listener
+
+	if l, err = net.Listen(network, address); err != nil {
+		return
+	}
+	err = s.ServeTLS(l, certFile, keyFile)
+	return
+}
+
+// ServeTLS serves requests on l over TLS
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) (err error) {
+	conf := &tls.Config{}
+	if s.TLSConfig != nil {
+		conf = s.TLSConfig.Clone()
+	}
+	if len(conf.Certificates) == 0 && conf.GetCertificate == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			l.Close()
+			return
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	err = s.Serve(tls.NewListener(l, conf))
+	return
+}
+
+// Serve accepts connections on l and serves them, l is closed
+// on return
+func (s *Server) Serve(l net.Listener) (err error) {
+	var conn net.Conn
+	var sleep time.Duration
+
+	defer l.Close()
+	if !s.track(l) {
+		err = ErrServerClosed
+		return
+	}
+	defer s.untrack(l)
+
+	for {
+		if conn, err = l.Accept(); err != nil {
+			if s.isClosed() {
+				err = ErrServerClosed
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				sleep = backoff(sleep)
+				s.logf("server: accept error: %v; retrying in %v", err, sleep)
+				time.Sleep(sleep)
+				continue
+			}
+			return
+		}
+		sleep = 0
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes the listeners and all connections immediately,
+// the contexts of the requests in progress are cancelled
+func (s *Server) Close() (err error) {
+	s.mu.Lock()
+	s.shutdown()
+	s.cancel()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	return
+}
+
+// Shutdown closes the listeners and waits for the requests in
+// progress to complete or ctx to be done
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.mu.Lock()
+	s.shutdown()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// shutdown must be called with s.mu held
+func (s *Server) shutdown() {
+	s.closed = true
+	s.init()
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+// init must be called with s.mu held
+func (s *Server) init() {
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.listeners = make(map[net.Listener]bool)
+		s.conns = make(map[net.Conn]bool)
+	}
+}
+
+func (s *Server) isClosed() (b bool) {
+	s.mu.Lock()
+	b = s.closed
+	s.mu.Unlock()
+	return
+}
+
+func (s *Server) track(l net.Listener) (ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.init()
+	if s.closed {
+		return
+	}
+	s.listeners[l] = true
+	ok = true
+	return
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) (ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		s.wg.Done()
+		return
+	}
+	if s.closed {
+		return
+	}
+	s.conns[c] = true
+	s.wg.Add(1)
+	ok = true
+	return
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	var r *Request
+	var err error
+
+	defer func() {
+		conn.Close()
+		s.trackConn(conn, false)
+	}()
+
+	if s.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err = tc.Handshake(); err != nil {
+			s.logf("server: TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	if r, err = ReadRequest(bufio.NewReader(conn)); err != nil {
+		s.logf("server: bad request from %s: %v", conn.RemoteAddr(), err)
+		w := newResponseWriter(-1)
+		w.WriteStatus(response.ExProtocol)
+		s.write(conn, w)
+		return
+	}
+	defer r.closeBody()
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	r.ctx = ctx
+	r.RemoteAddr = conn.RemoteAddr().String()
+	if tc, ok := conn.(*tls.Conn); ok {
+		st := tc.ConnectionState()
+		r.TLS = &st
+	}
+
+	w := newResponseWriter(r.Method)
+	s.serveRequest(w, r)
+	s.write(conn, w)
+}
+
+func (s *Server) serveRequest(w *responseWriter, r *Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.logf("server: panic serving %s: %v", r.RemoteAddr, v)
+			w.WriteStatus(response.ExSoftware)
+		}
+	}()
+
+	if s.Handler == nil {
+		w.WriteStatus(response.ExUnAvailable)
+		return
+	}
+	s.Handler.ServeSPAMD(w, r)
+}
+
+func (s *Server) write(conn net.Conn, w *responseWriter) {
+	if s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+	if err := w.flush(conn); err != nil {
+		s.logf("server: failed to write response to %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func backoff(d time.Duration) time.Duration {
+	if d == 0 {
+		return minAcceptSleep
+	}
+	if d *= 2; d > maxAcceptSleep {
+		d = maxAcceptSleep
+	}
+	return d
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+var testRules = response.Rules{
+	{Name: "BAYES_99", Score: 3.5, Description: "BODY: Bayes spam probability is 99 to 100%", HasScore: true},
+	{Name: "SPF_PASS", Score: -0.1, HasScore: true},
+}
+
+func newServer(t *testing.T, h Handler) (c *spamdclient.Client, addr string) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	addr = l.Addr().String()
+	s := &Server{Handler: h, ErrorLog: log.New(ioutil.Discard, "", 0)}
+	done := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	c, e = spamdclient.NewClientWithOptions(spamdclient.WithEndpoints(spamdclient.Endpoint{
+		Network: "tcp",
+		Address: addr,
+	}))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	return
+}
+
+func TestServe(t *testing.T) {
+	ctx := context.Background()
+	var user string
+	c, _ := newServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		user = r.User
+		w.Header().Set("Spam", SpamHeader(true, 8.2, 5))
+		switch r.Method {
+		case request.Symbols:
+			WriteSymbols(w, testRules)
+		case request.Report:
+			WriteReport(w, "localhost", 8.2, 5, testRules)
+		}
+	}))
+
+	if ok, e := c.Ping(ctx); e != nil || !ok {
+		t.Fatalf("Unexpected error: %v %t", e, ok)
+	}
+
+	c.SetUser("exim")
+	rs, e := c.Check(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if !rs.IsSpam || rs.Score != 8.2 || rs.BaseScore != 5 || user != "exim" {
+		t.Errorf("Got %t %v/%v %q want true 8.2/5 exim", rs.IsSpam, rs.Score, rs.BaseScore, user)
+	}
+
+	rs, e = c.Symbols(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if len(rs.Rules) != 2 || rs.Rules[0].Name != "BAYES_99" {
+		t.Errorf("Got %v want the rules", rs.Rules)
+	}
+
+	rs, e = c.Report(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	r, _ := rs.Rules.Lookup("SPF_PASS")
+	if len(rs.Rules) != 2 || r.Score != -0.1 || r.Description != noDescription {
+		t.Errorf("Got %v want the rules", rs.Rules)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+		switch r.User {
+		case "panic":
+			panic("boom")
+		case "denied":
+			w.WriteStatus(response.ExNoPerm)
+		}
+	}))
+	tests := []struct {
+		user string
+		code response.StatusCode
+	}{
+		{"panic", response.ExSoftware},
+		{"denied", response.ExNoPerm},
+	}
+	for _, tt := range tests {
+		c.SetUser(tt.user)
+		if _, e := c.Check(ctx, strings.NewReader(testMsg)); !errors.Is(e, tt.code) {
+			t.Errorf("Got %v want %s", e, tt.code)
+		}
+	}
+
+	c, _ = newServer(t, nil)
+	if _, e := c.Check(ctx, strings.NewReader(testMsg)); !errors.Is(e, response.ExUnAvailable) {
+		t.Errorf("Got %v want %s", e, response.ExUnAvailable)
+	}
+}
+
+func TestServeBadRequest(t *testing.T) {
+	_, addr := newServer(t, nil)
+	conn, e := net.Dial("tcp", addr)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer conn.Close()
+	conn.Write([]byte("FOO SPAMC/1.5\r\n\r\n"))
+	line, e := bufio.NewReader(conn).ReadString('\n')
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if line != "SPAMD/1.5 76 EX_PROTOCOL\r\n" {
+		t.Errorf("Got %q want the EX_PROTOCOL status", line)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	s := &Server{}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if e = s.Shutdown(ctx); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if e = <-done; e != ErrServerClosed {
+		t.Errorf("Got %v want %v", e, ErrServerClosed)
+	}
+	if e = s.Serve(l); e != ErrServerClosed {
+		t.Errorf("Got %v want %v", e, ErrServerClosed)
+	}
+}
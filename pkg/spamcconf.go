@@ -0,0 +1,308 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSpamcConfig is the default path of the spamc configuration file
+	DefaultSpamcConfig = "/etc/mail/spamassassin/spamc.conf"
+	defaultSpamdPort   = 783
+	configErr          = "Invalid spamc config at line %d: %s"
+)
+
+const (
+	noValue = iota
+	requiredValue
+	optionalValue
+)
+
+// spamcFlag describes an option accepted in a spamc.conf file
+type spamcFlag struct {
+	name  string
+	short byte
+	value int
+}
+
+var spamcFlags = []spamcFlag{
+	{"dest", 'd', requiredValue},
+	{"randomize", 'H', noValue},
+	{"port", 'p', requiredValue},
+	{"ssl", 'S', optionalValue},
+	{"ssl-cert", 0, requiredValue},
+	{"ssl-key", 0, requiredValue},
+	{"ssl-ca-file", 0, requiredValue},
+	{"socket", 'U', requiredValue},
+	{"timeout", 't', requiredValue},
+	{"connect-timeout", 'n', requiredValue},
+	{"filter-retries", 0, requiredValue},
+	{"filter-retry-sleep", 0, requiredValue},
+	{"connect-retries", 0, requiredValue},
+	{"retry-sleep", 0, requiredValue},
+	{"max-size", 's', requiredValue},
+	{"username", 'u', requiredValue},
+	{"learntype", 'L', requiredValue},
+	{"reporttype", 'C', requiredValue},
+	{"bsmtp", 'B', noValue},
+	{"check", 'c', noValue},
+	{"tests", 'y', noValue},
+	{"full-spam", 'r', noValue},
+	{"full", 'R', noValue},
+	{"headers", 0, noValue},
+	{"exitcode", 'E', noValue},
+	{"no-safe-fallback", 'x', noValue},
+	{"unavailable-tempfail", 'X', noValue},
+	{"log-to-stderr", 'l', noValue},
+	{"debug", 'D', noValue},
+	{"send-ping", 'K', noValue},
+	{"use-compression", 'z', noValue},
+	{"compart-f", 'f', noValue},
+	{"use-ipv4", '4', noValue},
+	{"use-ipv6", '6', noValue},
+}
+
+var numericOptions = map[string]bool{
+	"port":               true,
+	"timeout":            true,
+	"connect-timeout":    true,
+	"connect-retries":    true,
+	"retry-sleep":        true,
+	"filter-retries":     true,
+	"filter-retry-sleep": true,
+	"max-size":           true,
+}
+
+// A SpamcOption is an option read from a spamc.conf file
+type SpamcOption struct {
+	// Name is the long name of the option
+	Name string
+	// Value is empty for options without a value
+	Value string
+	// Line is the line the option was read from
+	Line int
+}
+
+// A SpamcConfig holds the options of a spamc.conf file in the
+// order they were read
+type SpamcConfig struct {
+	Options []SpamcOption
+}
+
+// A ConfigError is returned for an invalid spamc.conf line
+type ConfigError struct {
+	Line   int
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf(configErr, e.Line, e.Reason)
+}
+
+func lookupSpamcFlag(name string, short byte) *spamcFlag {
+	for i := range spamcFlags {
+		f := &spamcFlags[i]
+		if (name != "" && f.name == name) || (short != 0 && f.short == short) {
+			return f
+		}
+	}
+	return nil
+}
+
+// LoadSpamcConfig reads the spamc.conf file at path
+func LoadSpamcConfig(path string) (c *SpamcConfig, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+
+	c, err = ParseSpamcConfig(f)
+	return
+}
+
+// ParseSpamcConfig parses a spamc.conf file. Each line holds spamc
+// command line options, blank lines and lines starting with # are
+// ignored.
+func ParseSpamcConfig(r io.Reader) (c *SpamcConfig, err error) {
+	var n int
+
+	c = &SpamcConfig{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = c.parseLine(n, strings.Fields(line)); err != nil {
+			return
+		}
+	}
+	err = s.Err()
+	return
+}
+
+func (c *SpamcConfig) parseLine(n int, args []string) (err error) {
+	for i := 0; i < len(args); i++ {
+		var f *spamcFlag
+		var v string
+		var hasValue bool
+
+		a := args[i]
+		switch {
+		case strings.HasPrefix(a, "--") && len(a) > 2:
+			name := a[2:]
+			if j := strings.IndexByte(name, '='); j != -1 {
+				name, v, hasValue = name[:j], name[j+1:], true
+			}
+			if f = lookupSpamcFlag(name, 0); f == nil {
+				return &ConfigError{Line: n, Reason: "unknown option " + strconv.Quote(a)}
+			}
+		case strings.HasPrefix(a, "-") && len(a) > 1:
+			// shorthands may be grouped, the first one taking a
+			// value takes the rest of the group
+			for j := 1; j < len(a); j++ {
+				if f = lookupSpamcFlag("", a[j]); f == nil {
+					return &ConfigError{Line: n, Reason: "unknown option " + strconv.Quote("-"+a[j:j+1])}
+				}
+				if f.value == noValue {
+					c.Options = append(c.Options, SpamcOption{Name: f.name, Line: n})
+					continue
+				}
+				if j+1 < len(a) {
+					v, hasValue = strings.TrimPrefix(a[j+1:], "="), true
+				}
+				break
+			}
+			if f.value == noValue {
+				continue
+			}
+		default:
+			return &ConfigError{Line: n, Reason: "unexpected argument " + strconv.Quote(a)}
+		}
+
+		switch {
+		case f.value == noValue && hasValue:
+			return &ConfigError{Line: n, Reason: "option " + f.name + " does not take a value"}
+		case f.value == requiredValue && !hasValue:
+			if i+1 == len(args) {
+				return &ConfigError{Line: n, Reason: "option " + f.name + " requires a value"}
+			}
+			i++
+			v = args[i]
+		}
+		c.Options = append(c.Options, SpamcOption{Name: f.name, Value: v, Line: n})
+	}
+	return
+}
+
+// ClientOptions converts the options that configure the connection
+// to spamd to client Options, the options that only apply to the
+// command line tool are ignored. Like spamc localhost is used when
+// neither a dest nor a socket is set.
+func (c *SpamcConfig) ClientOptions() (opts []Option, err error) {
+	var socket, sslVersion, cert, key, ca string
+	var dests []string
+	var ssl bool
+	var network = "tcp"
+	var port = defaultSpamdPort
+	var filterRetries, filterSleep = 1, 3
+
+	for _, o := range c.Options {
+		var i int
+		if numericOptions[o.Name] {
+			if i, err = strconv.Atoi(o.Value); err != nil || i < 0 {
+				err = &ConfigError{Line: o.Line, Reason: "invalid value for " + o.Name + ": " + strconv.Quote(o.Value)}
+				return
+			}
+		}
+		switch o.Name {
+		case "dest":
+			dests = append(dests, strings.Split(o.Value, ",")...)
+		case "port":
+			port = i
+		case "socket":
+			socket = o.Value
+		case "use-ipv4":
+			network = "tcp4"
+		case "use-ipv6":
+			network = "tcp6"
+		case "username":
+			opts = append(opts, WithUser(o.Value))
+		case "timeout":
+			opts = append(opts, WithCmdTimeout(time.Duration(i)*time.Second))
+		case "connect-timeout":
+			opts = append(opts, WithConnTimeout(time.Duration(i)*time.Second))
+		case "connect-retries":
+			if i > 1 {
+				opts = append(opts, WithConnRetries(i-1))
+			}
+		case "retry-sleep":
+			opts = append(opts, WithConnSleep(time.Duration(i)*time.Second))
+		case "filter-retries":
+			filterRetries = i
+		case "filter-retry-sleep":
+			filterSleep = i
+		case "use-compression":
+			opts = append(opts, WithCompression())
+		case "ssl":
+			ssl, sslVersion = true, o.Value
+		case "ssl-cert":
+			cert = o.Value
+		case "ssl-key":
+			key = o.Value
+		case "ssl-ca-file":
+			ca = o.Value
+		}
+	}
+
+	if socket != "" {
+		opts = append(opts, WithEndpoint("unix", socket))
+	} else {
+		if len(dests) == 0 {
+			dests = []string{"localhost"}
+		}
+		for _, d := range dests {
+			if d = strings.Trim(d, "[]"); d == "" {
+				continue
+			}
+			opts = append(opts, WithEndpoint(network, net.JoinHostPort(d, strconv.Itoa(port))))
+		}
+	}
+	if filterRetries > 1 {
+		opts = append(opts, WithRetryPolicy(RetryPolicy{
+			MaxAttempts:    filterRetries,
+			InitialBackoff: time.Duration(filterSleep) * time.Second,
+			Multiplier:     1,
+		}))
+	}
+	if ssl {
+		var v uint16
+		if sslVersion == "" {
+			sslVersion = "tlsv1"
+		}
+		if v, err = ParseTLSVersion(sslVersion); err != nil {
+			return
+		}
+		opts = append(opts, WithTLS(), WithTLSVersion(v, 0))
+		if ca != "" {
+			opts = append(opts, WithRootCA(ca))
+		}
+		if cert != "" || key != "" {
+			opts = append(opts, WithClientCert(cert, key))
+		}
+	}
+	return
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSpamcConf = `# spamc global configuration
+
+-d spamd1.example.com,spamd2.example.com
+--port=1783
+-xz -u exim
+--connect-retries 3 --retry-sleep=2
+-t 60
+   # indented comment
+--ssl=tlsv1.2
+-s 1000000
+`
+
+func TestParseSpamcConfig(t *testing.T) {
+	c, e := ParseSpamcConfig(strings.NewReader(testSpamcConf))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	want := []SpamcOption{
+		{Name: "dest", Value: "spamd1.example.com,spamd2.example.com", Line: 3},
+		{Name: "port", Value: "1783", Line: 4},
+		{Name: "no-safe-fallback", Line: 5},
+		{Name: "use-compression", Line: 5},
+		{Name: "username", Value: "exim", Line: 5},
+		{Name: "connect-retries", Value: "3", Line: 6},
+		{Name: "retry-sleep", Value: "2", Line: 6},
+		{Name: "timeout", Value: "60", Line: 7},
+		{Name: "ssl", Value: "tlsv1.2", Line: 9},
+		{Name: "max-size", Value: "1000000", Line: 10},
+	}
+	if !reflect.DeepEqual(c.Options, want) {
+		t.Errorf("Got %+v want %+v", c.Options, want)
+	}
+}
+
+func TestParseSpamcConfigErrors(t *testing.T) {
+	tests := []struct {
+		in     string
+		line   int
+		reason string
+	}{
+		{"-c\n--frobnicate\n", 2, `unknown option "--frobnicate"`},
+		{"-cQ\n", 1, `unknown option "-Q"`},
+		{"-d\n", 1, "option dest requires a value"},
+		{"--check=yes\n", 1, "option check does not take a value"},
+		{"\n\nlocalhost\n", 3, `unexpected argument "localhost"`},
+	}
+	for _, tt := range tests {
+		_, e := ParseSpamcConfig(strings.NewReader(tt.in))
+		var ce *ConfigError
+		if !errors.As(e, &ce) {
+			t.Fatalf("%q: got %v want a ConfigError", tt.in, e)
+		}
+		if ce.Line != tt.line || ce.Reason != tt.reason {
+			t.Errorf("%q: got line %d %q want line %d %q", tt.in, ce.Line, ce.Reason, tt.line, tt.reason)
+		}
+	}
+}
+
+func TestSpamcConfigClientOptions(t *testing.T) {
+	c, e := ParseSpamcConfig(strings.NewReader(testSpamcConf + "--filter-retries 2\n"))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	opts, e := c.ClientOptions()
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	cl, e := NewClientWithOptions(opts...)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	want := []Endpoint{
+		{Network: "tcp", Address: "spamd1.example.com:1783"},
+		{Network: "tcp", Address: "spamd2.example.com:1783"},
+	}
+	var got []Endpoint
+	for _, ep := range cl.endpoints {
+		got = append(got, ep.Endpoint)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v want %v", got, want)
+	}
+	if cl.user != "exim" {
+		t.Errorf("Got %q want %q", cl.user, "exim")
+	}
+	if !cl.useCompression {
+		t.Errorf("Compression should be enabled")
+	}
+	if cl.cmdTimeout != time.Minute {
+		t.Errorf("Got %s want %s", cl.cmdTimeout, time.Minute)
+	}
+	if cl.connRetries != 2 || cl.connSleep != 2*time.Second {
+		t.Errorf("Got %d/%s want 2/2s", cl.connRetries, cl.connSleep)
+	}
+	if cl.retry.MaxAttempts != 2 {
+		t.Errorf("Got %d want 2", cl.retry.MaxAttempts)
+	}
+	if !cl.useTLS || cl.minTLSVersion != tls.VersionTLS12 {
+		t.Errorf("TLS 1.2 should be enabled")
+	}
+
+	dir, e := ioutil.TempDir("", "spamcconf")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "spamd.sock")
+	l, e := net.Listen("unix", sock)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer l.Close()
+	c, _ = ParseSpamcConfig(strings.NewReader("-U " + sock + "\n-d localhost\n"))
+	if opts, e = c.ClientOptions(); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if cl, e = NewClientWithOptions(opts...); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if len(cl.endpoints) != 1 || cl.endpoints[0].Network != "unix" {
+		t.Errorf("The socket should be the only endpoint")
+	}
+
+	tests := []struct {
+		conf    string
+		address string
+	}{
+		{"", "localhost:783"},
+		{"-p 1783\n", "localhost:1783"},
+	}
+	for _, tt := range tests {
+		c, _ = ParseSpamcConfig(strings.NewReader(tt.conf))
+		if opts, e = c.ClientOptions(); e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if cl, e = NewClientWithOptions(opts...); e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if len(cl.endpoints) != 1 || cl.endpoints[0].Address != tt.address {
+			t.Errorf("%q: got %v want %s", tt.conf, cl.endpoints, tt.address)
+		}
+	}
+
+	c, _ = ParseSpamcConfig(strings.NewReader("-t 0 -n 0\n"))
+	if opts, e = c.ClientOptions(); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if cl, e = NewClientWithOptions(opts...); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if cl.cmdTimeout != 0 || cl.connTimeout != 0 {
+		t.Errorf("Got %s, %s want 0s, 0s", cl.cmdTimeout, cl.connTimeout)
+	}
+
+	c, _ = ParseSpamcConfig(strings.NewReader("\n-p http\n"))
+	_, e = c.ClientOptions()
+	var ce *ConfigError
+	if !errors.As(e, &ce) || ce.Line != 2 {
+		t.Errorf("Got %v want a ConfigError at line 2", e)
+	}
+}
+
+func TestLoadSpamcConfig(t *testing.T) {
+	dir, e := ioutil.TempDir("", "spamcconf")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "spamc.conf")
+	if e = ioutil.WriteFile(p, []byte(testSpamcConf), 0644); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c, e := LoadSpamcConfig(p)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if len(c.Options) != 10 {
+		t.Errorf("Got %d options want 10", len(c.Options))
+	}
+	if _, e = LoadSpamcConfig(filepath.Join(dir, "missing.conf")); !os.IsNotExist(e) {
+		t.Errorf("Got %v want a not exist error", e)
+	}
+}
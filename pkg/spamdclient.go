@@ -16,15 +16,18 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/textproto"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/baruwa-enterprise/spamd-client/pkg/header"
@@ -44,6 +47,7 @@ const (
 	unsupportedProtoErr       = "Protocol: %s is not supported"
 	unixSockErr               = "The unix socket: %s does not exist"
 	noSizeErr                 = "The content length could not be determined"
+	noRewindErr               = "The message can not be resent"
 	responseReadErr           = "Failed to read server response"
 	invalidLearnTypeErr       = "Set the correct learn type"
 	rootCASizeErr             = "The RootCA file: %s is larger than max allowed: %d"
@@ -57,19 +61,53 @@ var (
 )
 
 // A Client represents a Spamd-client.
+//
+// A Client is safe for concurrent use by multiple goroutines. The
+// setters are safe to call at any time, but settings are best given
+// to NewClientWithOptions and overridden per request using
+// RequestOptions.
 type Client struct {
-	network            string
-	address            string
+	next    uint64
+	network string
+	address string
+	mu      sync.RWMutex
+	settings
+	sessionCache tls.ClientSessionCache
+	endpoints    []*endpoint
+}
+
+// settings holds the client settings, each request works
+// on its own copy
+type settings struct {
 	user               string
 	rootCA             string
+	rootCAs            *x509.CertPool
+	certificates       []tls.Certificate
+	minTLSVersion      uint16
+	maxTLSVersion      uint16
+	serverName         string
+	pins               [][]byte
+	tlsConf            *tls.Config
 	useTLS             bool
 	insecureSkipVerify bool
 	useCompression     bool
+	compressionLevel   int
+	compressionMinSize int64
 	returnRawBody      bool
+	verbatim           bool
 	connTimeout        time.Duration
 	connRetries        int
 	connSleep          time.Duration
 	cmdTimeout         time.Duration
+	useSpool           bool
+	spoolThreshold     int64
+	spoolDir           string
+	ejectCooldown      time.Duration
+	balancer           Balancer
+	retry              RetryPolicy
+	observer           Observer
+	logger             Logger
+	slowThreshold      time.Duration
 }
 
 // NewClient returns a new Spamd-client.
@@ -86,83 +124,210 @@ func NewClient(network, address, user string, useCompression bool) (c *Client, e
 		}
 	}
 
-	if network != "unix" && network != "unixpacket" && network != "tcp" && network != "tcp4" && network != "tcp6" {
-		err = fmt.Errorf(unsupportedProtoErr, network)
+	c, err = NewMultiClient([]Endpoint{{Network: network, Address: address}}, user, useCompression)
+	return
+}
+
+// NewMultiClient returns a new Spamd-client that balances requests
+// across the endpoints and fails over to the next endpoint when one
+// fails to dial, times out or returns a temporary status. Unix
+// sockets are checked when dialing so a missing one only fails
+// over to the other endpoints.
+func NewMultiClient(endpoints []Endpoint, user string, useCompression bool) (c *Client, err error) {
+	c = newClient()
+	c.user = user
+	c.useCompression = useCompression
+	if err = c.setEndpoints(endpoints); err != nil {
+		c = nil
+	}
+	return
+}
+
+func newClient() *Client {
+	return &Client{
+		settings: settings{
+			compressionLevel: zlib.DefaultCompression,
+			connSleep:        defaultSleep,
+			connTimeout:      defaultTimeout,
+			cmdTimeout:       defaultCmdTimeout,
+			useSpool:         true,
+			spoolThreshold:   defaultSpoolThreshold,
+			ejectCooldown:    defaultEjectCooldown,
+			observer:         NopObserver{},
+			logger:           nopLogger{},
+			slowThreshold:    defaultSlowThreshold,
+		},
+		sessionCache: tls.NewLRUClientSessionCache(0),
+	}
+}
+
+func (c *Client) setEndpoints(endpoints []Endpoint) (err error) {
+	if len(endpoints) == 0 {
+		err = fmt.Errorf(noEndpointsErr)
 		return
 	}
 
-	c = &Client{
-		network:        network,
-		address:        address,
-		user:           user,
-		useCompression: useCompression,
-		connSleep:      defaultSleep,
-		connTimeout:    defaultTimeout,
-		cmdTimeout:     defaultCmdTimeout,
+	eps := make([]*endpoint, len(endpoints))
+	for i, e := range endpoints {
+		if err = checkEndpoint(e.Network, e.Address); err != nil {
+			return
+		}
+		eps[i] = &endpoint{Endpoint: e}
+	}
+
+	c.network = endpoints[0].Network
+	c.address = endpoints[0].Address
+	c.endpoints = eps
+	return
+}
+
+// settingsFor returns a copy of the client settings with
+// the request overrides applied
+func (c *Client) settingsFor(o *RequestOptions) (s settings) {
+	c.mu.RLock()
+	s = c.settings
+	c.mu.RUnlock()
+
+	if o == nil {
+		return
+	}
+	if o.User != "" {
+		s.user = o.User
+	}
+	if o.RawBody != nil {
+		s.returnRawBody = *o.RawBody
+	}
+	s.verbatim = o.Verbatim
+	if o.Timeout > 0 {
+		s.cmdTimeout = o.Timeout
+	}
+	return
+}
+
+func checkEndpoint(network, address string) (err error) {
+	if network != "unix" && network != "unixpacket" && network != "tcp" && network != "tcp4" && network != "tcp6" {
+		err = fmt.Errorf(unsupportedProtoErr, network)
+		return
 	}
 	return
 }
 
 // SetUser sets the user
 func (c *Client) SetUser(u string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.user = u
 }
 
 // EnableCompression enables compression
 func (c *Client) EnableCompression() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.useCompression = true
 }
 
 // DisableCompression disables compression
 func (c *Client) DisableCompression() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.useCompression = false
 }
 
+// SetCompressionLevel sets the zlib compression level, values
+// outside zlib.HuffmanOnly to zlib.BestCompression are ignored
+func (c *Client) SetCompressionLevel(l int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if l >= zlib.HuffmanOnly && l <= zlib.BestCompression {
+		c.compressionLevel = l
+	}
+}
+
+// SetCompressionMinSize sets the message size in bytes below
+// which compression is skipped
+func (c *Client) SetCompressionMinSize(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n >= 0 {
+		c.compressionMinSize = n
+	}
+}
+
 // EnableTLS enables TLS
 func (c *Client) EnableTLS() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.useTLS = true
 }
 
 // DisableTLS disables TLS
 func (c *Client) DisableTLS() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.useTLS = false
 }
 
 // EnableRawBody enables returning the raw body
 func (c *Client) EnableRawBody() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.returnRawBody = true
 }
 
 // DisableRawBody enables returning the raw body
 func (c *Client) DisableRawBody() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.returnRawBody = false
 }
 
-// SetRootCA sets the path to the RootCA file
+// SetRootCA sets the path to the RootCA file, the file is
+// loaded and an error returned if it has no valid certificate
 func (c *Client) SetRootCA(p string) (err error) {
-	var s os.FileInfo
-	if s, err = os.Stat(p); os.IsNotExist(err) || s.Size() > maxCertSize {
-		if err == nil {
-			err = fmt.Errorf(rootCASizeErr, p, maxCertSize)
-		}
+	var pool *x509.CertPool
+
+	if pool, err = loadRootCA(p); err != nil {
 		return
 	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.rootCA = p
+	c.rootCAs = pool
 	return
 }
 
 // EnableTLSVerification enables verification of the server certificate
 func (c *Client) EnableTLSVerification() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.insecureSkipVerify = false
 }
 
 // DisableTLSVerification disables verification of the server certificate
 func (c *Client) DisableTLSVerification() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.insecureSkipVerify = true
 }
 
 // SetConnTimeout sets the connection timeout
 func (c *Client) SetConnTimeout(t time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if t > 0 {
 		c.connTimeout = t
 	}
@@ -170,6 +335,9 @@ func (c *Client) SetConnTimeout(t time.Duration) {
 
 // SetCmdTimeout sets the cmd timeout
 func (c *Client) SetCmdTimeout(t time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if t > 0 {
 		c.cmdTimeout = t
 	}
@@ -178,6 +346,9 @@ func (c *Client) SetCmdTimeout(t time.Duration) {
 // SetConnRetries sets the number of times
 // connection is retried
 func (c *Client) SetConnRetries(s int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if s < 0 {
 		s = 0
 	}
@@ -187,21 +358,147 @@ func (c *Client) SetConnRetries(s int) {
 // SetConnSleep sets the connection retry sleep
 // duration in seconds
 func (c *Client) SetConnSleep(s time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if s > 0 {
 		c.connSleep = s
 	}
 }
 
+// EnableSpooling enables spooling of messages of unknown length
+func (c *Client) EnableSpooling() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.useSpool = true
+}
+
+// DisableSpooling disables spooling of messages of unknown length
+func (c *Client) DisableSpooling() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.useSpool = false
+}
+
+// SetSpoolThreshold sets the size in bytes above which messages
+// of unknown length are spooled to a temp file instead of memory
+func (c *Client) SetSpoolThreshold(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n >= 0 {
+		c.spoolThreshold = n
+	}
+}
+
+// SetSpoolDir sets the directory used for spool temp files, the
+// default temp directory is used when empty
+func (c *Client) SetSpoolDir(d string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.spoolDir = d
+}
+
+// SetBalancer sets the endpoint selection strategy
+func (c *Client) SetBalancer(b Balancer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.balancer = b
+}
+
+// SetEjectCooldown sets the period a failing endpoint is
+// ejected from selection
+func (c *Client) SetEjectCooldown(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if d >= 0 {
+		c.ejectCooldown = d
+	}
+}
+
+// SetObserver sets the Observer called at each phase of a
+// request, nil removes it
+func (c *Client) SetObserver(o Observer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if o == nil {
+		o = NopObserver{}
+	}
+	c.observer = o
+}
+
+// EnablePool enables a pool of pre-dialed connections for each
+// endpoint, existing pools are closed and replaced
+func (c *Client) EnablePool(conf PoolConfig) {
+	for _, ep := range c.endpoints {
+		if p := ep.setPool(newPool(conf, c.dialer(ep))); p != nil {
+			p.Close()
+		}
+	}
+}
+
+// DisablePool closes the pools of pre-dialed connections
+func (c *Client) DisablePool() {
+	for _, ep := range c.endpoints {
+		if p := ep.setPool(nil); p != nil {
+			p.Close()
+		}
+	}
+}
+
+// PoolStats returns the connection pool statistics summed
+// across all endpoints
+func (c *Client) PoolStats() (s PoolStats) {
+	for _, ep := range c.endpoints {
+		p := ep.getPool()
+		if p == nil {
+			continue
+		}
+		ps := p.Stats()
+		s.Open += ps.Open
+		s.Idle += ps.Idle
+		s.InUse += ps.InUse
+		s.Hits += ps.Hits
+		s.Misses += ps.Misses
+		s.Dials += ps.Dials
+		s.DialErrors += ps.DialErrors
+		s.Expired += ps.Expired
+		s.WaitCount += ps.WaitCount
+		s.WaitDuration += ps.WaitDuration
+	}
+	return
+}
+
+// Close releases the pre-dialed connections held by the client
+func (c *Client) Close() (err error) {
+	for _, ep := range c.endpoints {
+		p := ep.getPool()
+		if p == nil {
+			continue
+		}
+		if e := p.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
 // Check requests the SPAMD service to check a message with a CHECK request.
 func (c *Client) Check(ctx context.Context, r io.Reader) (rs *response.Response, err error) {
-	rs, err = c.cmd(ctx, request.Check, request.NoAction, request.NoneType, r)
+	rs, err = c.cmd(ctx, request.Check, request.NoAction, request.NoneType, r, nil)
 	return
 }
 
 // Headers requests the SPAMD service to check a message with a
 // HEADERS request.
 func (c *Client) Headers(ctx context.Context, r io.Reader) (rs *response.Response, err error) {
-	rs, err = c.cmd(ctx, request.Headers, request.NoAction, request.NoneType, r)
+	rs, err = c.cmd(ctx, request.Headers, request.NoAction, request.NoneType, r, nil)
 	return
 }
 
@@ -209,7 +506,7 @@ func (c *Client) Headers(ctx context.Context, r io.Reader) (rs *response.Respons
 // a response if the service is alive.
 func (c *Client) Ping(ctx context.Context) (s bool, err error) {
 	var rs *response.Response
-	rs, err = c.cmd(ctx, request.Ping, request.NoAction, request.NoneType, nil)
+	rs, err = c.cmd(ctx, request.Ping, request.NoAction, request.NoneType, nil, nil)
 	if err == nil {
 		s = rs.StatusCode == response.ExOK
 	}
@@ -219,38 +516,34 @@ func (c *Client) Ping(ctx context.Context) (s bool, err error) {
 // Process requests the SPAMD service to check a message with a
 // PROCESS request.
 func (c *Client) Process(ctx context.Context, r io.Reader) (rs *response.Response, err error) {
-	rs, err = c.cmd(ctx, request.Process, request.NoAction, request.NoneType, r)
+	rs, err = c.cmd(ctx, request.Process, request.NoAction, request.NoneType, r, nil)
 	return
 }
 
 // Report requests the SPAMD service to check a message with a
 // REPORT request.
 func (c *Client) Report(ctx context.Context, r io.Reader) (rs *response.Response, err error) {
-	rs, err = c.cmd(ctx, request.Report, request.NoAction, request.NoneType, r)
+	rs, err = c.cmd(ctx, request.Report, request.NoAction, request.NoneType, r, nil)
 	return
 }
 
 // ReportIfSpam requests the SPAMD service to check a message with a
 // REPORT_IFSPAM request.
 func (c *Client) ReportIfSpam(ctx context.Context, r io.Reader) (rs *response.Response, err error) {
-	rs, err = c.cmd(ctx, request.ReportIfSpam, request.NoAction, request.NoneType, r)
+	rs, err = c.cmd(ctx, request.ReportIfSpam, request.NoAction, request.NoneType, r, nil)
 	return
 }
 
 // Symbols requests the SPAMD service to check a message with a
 // SYMBOLS request.
 func (c *Client) Symbols(ctx context.Context, r io.Reader) (rs *response.Response, err error) {
-	rs, err = c.cmd(ctx, request.Symbols, request.NoAction, request.NoneType, r)
+	rs, err = c.cmd(ctx, request.Symbols, request.NoAction, request.NoneType, r, nil)
 	return
 }
 
 // Tell instructs the SPAMD service to to mark the message
 func (c *Client) Tell(ctx context.Context, r io.Reader, l request.MsgType, a request.TellAction) (rs *response.Response, err error) {
-	if l < request.Ham || l > request.Spam {
-		err = fmt.Errorf(invalidLearnTypeErr)
-		return
-	}
-	rs, err = c.cmd(ctx, request.Tell, a, l, r)
+	rs, err = c.Do(ctx, request.Tell, r, &RequestOptions{MsgType: l, Action: a})
 	return
 }
 
@@ -266,87 +559,244 @@ func (c *Client) Revoke(ctx context.Context, r io.Reader) (rs *response.Response
 	return
 }
 
-func (c *Client) tlsConfig() (conf *tls.Config) {
-	var ca []byte
-	var err error
+func (c *Client) cmd(ctx context.Context, rq request.Method, a request.TellAction, l request.MsgType, r io.Reader, o *RequestOptions) (rs *response.Response, err error) {
+	var b *body
+	var sent bool
+
+	s := c.settingsFor(o)
+
+	start := time.Now()
+	st := &RequestStats{Method: rq}
+	s.observer.RequestStart(rq)
+	defer func() {
+		st.Duration = time.Since(start)
+		st.Err = err
+		if rs != nil {
+			st.Code = rs.StatusCode
+			st.HasStatus = true
+		}
+		s.observer.RequestDone(st)
+		s.logRequest(st)
+	}()
 
-	conf = &tls.Config{
-		InsecureSkipVerify: c.insecureSkipVerify,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		},
+	if r != nil {
+		if b, err = s.newBody(r); err != nil {
+			return
+		}
+		defer b.Close()
+		if s.useCompression && rq.UsesHeader(header.Compress) && b.size >= s.compressionMinSize {
+			var cb *body
+			if cb, err = s.compress(b); err != nil {
+				return
+			}
+			b = cb
+		}
+		// The body has to be resent when failing over or retrying
+		if (len(c.endpoints) > 1 || s.retry.enabled()) && s.useSpool {
+			if err = s.rewindable(b); err != nil {
+				return
+			}
+		}
+	}
+
+	if s.retry.MaxElapsed > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.retry.MaxElapsed)
+		defer cancel()
 	}
 
-	if c.rootCA != "" {
-		if ca, err = ioutil.ReadFile(c.rootCA); err != nil {
+	for n := 0; ; n++ {
+		rs, sent, err = c.failover(ctx, &s, st, rq, a, l, b, sent)
+		if n+1 >= s.retry.MaxAttempts || ctx.Err() != nil || !s.retry.retryable(err) {
+			return
+		}
+		if sent && b != nil && b.start < 0 {
+			return
+		}
+		d := s.retry.backoff(n)
+		s.logger.Info("retrying spamd request", "method", rq, "user", s.user,
+			"endpoint", st.Endpoint.Address, "attempt", n+1, "backoff", d, "error", err)
+		if !s.retry.wait(ctx, d) {
 			return
 		}
-		p := x509.NewCertPool()
-		p.AppendCertsFromPEM(ca)
-		conf.RootCAs = p
 	}
+}
+
+// failover tries each endpoint in turn until one serves the request
+// or fails in a way that another endpoint would not help
+func (c *Client) failover(ctx context.Context, s *settings, st *RequestStats, rq request.Method, a request.TellAction, l request.MsgType, b *body, sent bool) (rs *response.Response, wasSent bool, err error) {
+	var ep *endpoint
 
+	wasSent = sent
+	tried := make(map[*endpoint]bool)
+	for {
+		if ep = c.pick(s.balancer, tried); ep == nil {
+			return
+		}
+		if wasSent && b != nil {
+			if b.start < 0 {
+				return
+			}
+			if err = b.rewind(); err != nil {
+				return
+			}
+		}
+		tried[ep] = true
+		st.Attempts++
+		st.Endpoint = ep.Endpoint
+
+		atomic.AddInt64(&ep.inflight, 1)
+		rs, sent, err = c.sendRedial(ctx, ep, s, rq, a, l, b)
+		atomic.AddInt64(&ep.inflight, -1)
+		wasSent = wasSent || sent
+
+		if ctx.Err() != nil || !shouldFailover(err) {
+			ep.restore()
+			return
+		}
+		s.logger.Warn("spamd endpoint failed", "endpoint", ep.Address, "method", rq,
+			"user", s.user, "error", err)
+		ep.eject(s.ejectCooldown)
+	}
+}
+
+// deadline returns the earlier of the cmd timeout and
+// the context deadline
+func deadline(ctx context.Context, timeout time.Duration) (d time.Time, ok bool) {
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+		ok = true
+	}
+	if cd, has := ctx.Deadline(); has && (!ok || cd.Before(d)) {
+		d = cd
+		ok = true
+	}
 	return
 }
 
-type readerWithLen interface {
-	Len() int
+// ctxErr returns the context error, the deadline is checked as well
+// since the connection deadline can fire before the context is done
+func ctxErr(ctx context.Context) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		err = context.DeadlineExceeded
+	}
+	return
+}
+
+// shouldFailover returns true when a request failed in a way that
+// another endpoint may be able to serve it
+func shouldFailover(err error) bool {
+	return IsTemporary(err)
+}
+
+// isStale returns true when a request failed before the first
+// response byte in a way that a connection closed by spamd does
+func isStale(err error) bool {
+	return errors.Is(err, ErrNoResponse) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// sendRedial performs a request against a single endpoint, a pre-dialed
+// connection that spamd closed while idle is replaced by a new one
+// and the request is sent again when the body can be rewound
+func (c *Client) sendRedial(ctx context.Context, ep *endpoint, s *settings, rq request.Method, a request.TellAction, l request.MsgType, b *body) (rs *response.Response, sent bool, err error) {
+	var reused bool
+
+	rs, sent, reused, err = c.send(ctx, ep, s, rq, a, l, b, false)
+	if !reused || rs != nil || ctx.Err() != nil || !isStale(err) {
+		return
+	}
+	if b != nil && (b.start < 0 || b.rewind() != nil) {
+		return
+	}
+	s.logger.Debug("redialing stale pooled connection", "endpoint", ep.Address,
+		"method", rq, "error", err)
+	rs, sent, _, err = c.send(ctx, ep, s, rq, a, l, b, true)
+	return
 }
 
-func (c *Client) cmd(ctx context.Context, rq request.Method, a request.TellAction, l request.MsgType, r io.Reader) (rs *response.Response, err error) {
+// send performs a request against a single endpoint, sent is set
+// once the body has started to be read and reused when a pre-dialed
+// connection was used, fresh skips the pre-dialed connections
+func (c *Client) send(ctx context.Context, ep *endpoint, s *settings, rq request.Method, a request.TellAction, l request.MsgType, b *body, fresh bool) (rs *response.Response, sent, reused bool, err error) {
 	var line string
 	var conn net.Conn
 	var tc *textproto.Conn
 
+	ctx, at := newAttempt(ctx, s.observer, rq, ep.Endpoint)
+	defer func() {
+		at.done(rs, err)
+		s.logAnomaly(ep, rq, err)
+	}()
+
+	// Report the context error when the context ended the request
+	defer func() {
+		if err != nil {
+			if e := ctxErr(ctx); e != nil {
+				rs = nil
+				err = e
+			}
+		}
+	}()
+
 	// Setup the socket connection
-	if conn, err = c.dial(ctx); err != nil {
+	start := time.Now()
+	conn, err = c.dial(ctx, ep, s, fresh)
+	at.Connect = time.Since(start)
+	if err != nil {
+		err = &DialError{Network: ep.Network, Address: ep.Address, Err: err}
 		return
 	}
+	sent = true
+	if pc, ok := conn.(*poolConn); ok {
+		reused = pc.reused
+	}
 
-	if c.cmdTimeout > 0 {
-		conn.SetDeadline(time.Now().Add(c.cmdTimeout))
+	if d, ok := deadline(ctx, s.cmdTimeout); ok {
+		conn.SetDeadline(d)
 	}
 
-	tc = textproto.NewConn(conn)
+	tc = textproto.NewConn(&countingConn{Conn: conn, a: at})
 	defer tc.Close()
 
+	// Close the connection at once when the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
 	// Send the request
 	id := tc.Next()
 	tc.StartRequest(id)
 	tc.PrintfLine("%s SPAMC/%s", rq, ClientVersion)
 
+	// A line ending is sent after uncompressed bodies unless verbatim
+	trailer := b != nil && !b.compressed && !s.verbatim
+
 	// Send the headers
 	// Content-length needs to be send first
-	if r != nil {
-		var clen int64
-		var stat os.FileInfo
-		switch v := r.(type) {
-		case readerWithLen:
-			clen = int64(v.Len())
-		case *os.File:
-			if stat, err = v.Stat(); err != nil {
-				tc.EndRequest(id)
-				return
-			}
-			clen = stat.Size()
-		default:
-			err = fmt.Errorf(noSizeErr)
-			tc.EndRequest(id)
-			return
+	if b != nil {
+		if !trailer {
+			tc.PrintfLine("Content-length: %d", b.size)
+		} else {
+			tc.PrintfLine("Content-length: %d", b.size+2)
 		}
-		clen += 2
-		tc.PrintfLine("Content-length: %d", clen)
 	}
 	// Compress
-	if c.useCompression && rq.UsesHeader(header.Compress) {
+	if b != nil && b.compressed {
 		tc.PrintfLine("Compress: %s", "zlib")
 	}
 	// User
-	if c.user != "" && rq.UsesHeader(header.User) {
-		tc.PrintfLine("User: %s", c.user)
+	if s.user != "" && rq.UsesHeader(header.User) {
+		tc.PrintfLine("User: %s", s.user)
 	}
 	// Tell headers
 	if rq == request.Tell {
@@ -368,22 +818,20 @@ func (c *Client) cmd(ctx context.Context, rq request.Method, a request.TellActio
 
 	// Send the newline separating headers and body
 	tc.PrintfLine("")
-	if r != nil {
+	if b != nil {
 		// Send the body
-		if c.useCompression {
-			w := zlib.NewWriter(tc.Writer.W)
-			if _, err = io.Copy(w, r); err != nil {
-				tc.EndRequest(id)
-				return
-			}
-			w.Close()
-		} else {
-			if _, err = io.Copy(tc.Writer.W, r); err != nil {
-				tc.EndRequest(id)
-				return
-			}
+		if _, err = io.CopyN(tc.Writer.W, b.r, b.size); err != nil {
+			s.observer.WroteRequest(ep.Endpoint, err)
+			tc.EndRequest(id)
+			return
+		}
+		if trailer {
+			tc.PrintfLine("")
+		} else if err = tc.Writer.W.Flush(); err != nil {
+			s.observer.WroteRequest(ep.Endpoint, err)
+			tc.EndRequest(id)
+			return
 		}
-		tc.PrintfLine("")
 	}
 
 	// Close the write side of the socket
@@ -391,6 +839,8 @@ func (c *Client) cmd(ctx context.Context, rq request.Method, a request.TellActio
 		v.CloseWrite()
 	}
 
+	s.observer.WroteRequest(ep.Endpoint, nil)
+
 	tc.EndRequest(id)
 	tc.StartResponse(id)
 	defer tc.EndResponse(id)
@@ -399,22 +849,31 @@ func (c *Client) cmd(ctx context.Context, rq request.Method, a request.TellActio
 	line, err = tc.ReadLine()
 	if err != nil {
 		if err == io.EOF {
-			err = fmt.Errorf(responseReadErr)
+			err = ErrNoResponse
 		}
 		return
 	}
 
+	at.gotStatus = time.Now()
+
 	m := responseRe.FindStringSubmatch(line)
 	if m == nil {
-		err = fmt.Errorf(invalidRespErr, line)
+		err = &ProtocolError{Line: line}
 		return
 	}
 
 	rs = response.NewResponse(rq)
+	rs.Endpoint = ep.Address
 	rs.StatusCode = response.StatusCodes[m[3]]
 	rs.StatusMsg = m[0]
 	rs.Version = m[1]
 
+	// An error status is not followed by headers
+	if rs.StatusCode != response.ExOK {
+		err = &ServerError{Code: rs.StatusCode}
+		return
+	}
+
 	// CHECK returns only headers no body
 	// HEADERS returns headers and body (modified headers)
 	// PING returns no headers and no body
@@ -451,44 +910,134 @@ func (c *Client) cmd(ctx context.Context, rq request.Method, a request.TellActio
 		}
 		// HEADERS, PROCESS
 		if rq == request.Headers || rq == request.Process {
-			err = c.headers(tc, rs)
+			err = c.headers(tc, rs, s.returnRawBody)
 		}
 		// REPORT, REPORT_IFSPAM
 		if rq == request.Report || rq == request.ReportIfSpam {
-			err = c.report(tc, rs)
+			err = c.report(tc, rs, s.returnRawBody)
 		}
 		// SYMBOLS
 		if rq == request.Symbols {
-			err = c.symbols(tc, rs)
+			err = c.symbols(tc, rs, s.returnRawBody)
 		}
 	}
 	return
 }
 
-func (c *Client) dial(ctx context.Context) (conn net.Conn, err error) {
+func (c *Client) dial(ctx context.Context, ep *endpoint, s *settings, fresh bool) (conn net.Conn, err error) {
+	if p := ep.getPool(); p != nil {
+		conn, err = p.get(ctx, fresh)
+		return
+	}
+	conn, err = c.dialConn(ctx, ep, s)
+	return
+}
+
+// dialer returns the dial function used by the pool, it dials
+// with the settings current at the time of the dial
+func (c *Client) dialer(ep *endpoint) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		s := c.settingsFor(nil)
+		return c.dialConn(ctx, ep, &s)
+	}
+}
+
+func (c *Client) dialConn(ctx context.Context, ep *endpoint, s *settings) (conn net.Conn, err error) {
 	d := &net.Dialer{}
 
-	if c.connTimeout > 0 {
-		d.Timeout = c.connTimeout
+	if s.connTimeout > 0 {
+		d.Timeout = s.connTimeout
 	}
 
-	for i := 0; i <= c.connRetries; i++ {
-		if c.useTLS && strings.HasPrefix(c.network, "tcp") {
-			conf := c.tlsConfig()
-			td := tls.Dialer{
-				NetDialer: d,
-				Config:    conf,
-			}
-			conn, err = td.DialContext(ctx, c.network, c.address)
-		} else {
-			conn, err = d.DialContext(ctx, c.network, c.address)
+	s.observer.DialStart(ep.Endpoint)
+	defer func() {
+		s.observer.DialDone(ep.Endpoint, err)
+	}()
+
+	// a missing socket is checked at dial time so that the
+	// other endpoints are still used
+	if ep.Network == "unix" || ep.Network == "unixpacket" {
+		if _, err = os.Stat(ep.Address); os.IsNotExist(err) {
+			err = fmt.Errorf(unixSockErr, ep.Address)
+			return
 		}
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			time.Sleep(c.connSleep)
-			continue
+	}
+
+	for i := 0; i <= s.connRetries; i++ {
+		s.logger.Debug("dialing spamd", "endpoint", ep.Address, "attempt", i+1)
+		start := time.Now()
+		if conn, err = d.DialContext(ctx, ep.Network, ep.Address); err == nil &&
+			s.useTLS && strings.HasPrefix(ep.Network, "tcp") {
+			conn, err = c.handshake(ctx, conn, ep, s, start)
+		}
+		if err != nil {
+			s.logger.Warn("spamd dial failed", "endpoint", ep.Address, "attempt", i+1,
+				"duration", time.Since(start), "error", err)
+		}
+		if e, ok := err.(net.Error); !ok || !e.Timeout() || i == s.connRetries {
+			break
+		}
+		t := time.NewTimer(s.connSleep)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			err = ctx.Err()
+			return
+		case <-t.C:
+		}
+	}
+	return
+}
+
+// handshake performs the TLS handshake on raw, the connect
+// timeout covers both the dial started at start and the handshake
+func (c *Client) handshake(ctx context.Context, raw net.Conn, ep *endpoint, s *settings, start time.Time) (conn net.Conn, err error) {
+	conf := c.tlsConfig(s)
+	if conf.ServerName == "" {
+		host := ep.Address
+		if h, _, e := net.SplitHostPort(host); e == nil {
+			host = h
+		}
+		conf.ServerName = host
+	}
+
+	var d time.Time
+	if s.connTimeout > 0 {
+		d = start.Add(s.connTimeout)
+	}
+	if cd, ok := ctx.Deadline(); ok && (d.IsZero() || cd.Before(d)) {
+		d = cd
+	}
+	raw.SetDeadline(d)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			raw.Close()
+		case <-done:
 		}
-		break
+	}()
+
+	hs := time.Now()
+	s.observer.TLSHandshakeStart(ep.Endpoint)
+	tc := tls.Client(raw, conf)
+	err = tc.Handshake()
+	s.observer.TLSHandshakeDone(ep.Endpoint, err)
+	if a := attemptFrom(ctx); a != nil {
+		a.TLSHandshake = time.Since(hs)
 	}
+
+	if err != nil {
+		raw.Close()
+		if e := ctx.Err(); e != nil {
+			err = e
+		}
+		return
+	}
+	raw.SetDeadline(time.Time{})
+	conn = tc
 	return
 }
 
@@ -496,7 +1045,7 @@ func (c *Client) spamHeader(rs *response.Response) (err error) {
 	line := rs.Headers.Get("Spam")
 	m := spamHeaderRe.FindStringSubmatch(line)
 	if m == nil {
-		err = fmt.Errorf(invalidRespErr, line)
+		err = &ProtocolError{Line: line}
 		return
 	}
 	tv := strings.ToLower(m[1])
@@ -504,30 +1053,32 @@ func (c *Client) spamHeader(rs *response.Response) (err error) {
 		rs.IsSpam = true
 	}
 	if rs.Score, err = strconv.ParseFloat(m[2], 64); err != nil {
-		err = fmt.Errorf(invalidRespErr, err)
+		err = &ProtocolError{Line: line}
 		return
 	}
 	if rs.BaseScore, err = strconv.ParseFloat(m[3], 64); err != nil {
-		err = fmt.Errorf(invalidRespErr, err)
+		err = &ProtocolError{Line: line}
 		return
 	}
 	return
 }
 
-func (c *Client) headers(tc *textproto.Conn, rs *response.Response) (err error) {
+func (c *Client) headers(tc *textproto.Conn, rs *response.Response, raw bool) (err error) {
 	var s bool
 	var lineb []byte
 	var tp *textproto.Reader
-	if c.returnRawBody {
+	if raw {
 		for {
-			if lineb, err = tc.R.ReadBytes('\n'); err != nil {
+			lineb, err = tc.R.ReadBytes('\n')
+			// the last line may not end with a newline
+			rs.Raw = append(rs.Raw, lineb...)
+			if err != nil {
 				if err == io.EOF {
 					err = nil
 					break
 				}
 				return
 			}
-			rs.Raw = append(rs.Raw, lineb...)
 		}
 		tp = textproto.NewReader(bufio.NewReader(bytes.NewReader(rs.Raw)))
 		rs.Msg.Header, err = tp.ReadMIMEHeader()
@@ -539,11 +1090,15 @@ func (c *Client) headers(tc *textproto.Conn, rs *response.Response) (err error)
 		return
 	}
 
+	r := tc.R
+	if raw {
+		r = tp.R
+	}
 	for {
-		if c.returnRawBody {
-			lineb, err = tp.R.ReadBytes('\n')
+		if s {
+			lineb, err = readRuleLine(r)
 		} else {
-			lineb, err = tc.R.ReadBytes('\n')
+			lineb, err = r.ReadBytes('\n')
 		}
 
 		if err != nil {
@@ -559,12 +1114,7 @@ func (c *Client) headers(tc *textproto.Conn, rs *response.Response) (err error)
 		if s {
 			mb := ruleRe.FindSubmatch(lineb)
 			if mb != nil {
-				rd := make(map[string]string)
-				rd["score"] = string(mb[1])
-				rd["name"] = string(mb[2])
-				rd["description"] = string(mb[3])
-
-				rs.Rules = append(rs.Rules, rd)
+				rs.Rules = append(rs.Rules, newRule(mb))
 			}
 		}
 		if bytes.Equal(lineb, []byte("\r\n")) {
@@ -574,35 +1124,18 @@ func (c *Client) headers(tc *textproto.Conn, rs *response.Response) (err error)
 	}
 }
 
-func (c *Client) report(tc *textproto.Conn, rs *response.Response) (err error) {
+func (c *Client) report(tc *textproto.Conn, rs *response.Response, raw bool) (err error) {
 	var s bool
 	var lineb []byte
 	for {
-		if lineb, err = tc.R.ReadBytes('\n'); err != nil {
+		if lineb, err = readRuleLine(tc.R); err != nil {
 			if err == io.EOF {
 				err = nil
 			}
 			return
 		}
 
-		// Some rules are continued on the next line so
-		// for the regex to work further down we need to
-		// read the full continued line here
-		if !bytes.Equal(lineb, []byte("\n")) {
-			if tc.R.Buffered() > 2 {
-				peek, e := tc.R.Peek(2)
-				if e == nil && isASCIISpace(peek[1]) {
-					// read the next line
-					var tmpline []byte
-					tmpline, err = tc.R.ReadBytes('\n')
-					if err == nil {
-						lineb = append(lineb, tmpline...)
-					}
-				}
-			}
-		}
-
-		if c.returnRawBody {
+		if raw {
 			rs.Raw = append(rs.Raw, lineb...)
 		}
 
@@ -621,20 +1154,36 @@ func (c *Client) report(tc *textproto.Conn, rs *response.Response) (err error) {
 
 		mb := ruleRe.FindSubmatch(bytes.TrimRight(lineb, "\n"))
 		if mb == nil {
-			err = fmt.Errorf(invalidRespErr, lineb)
+			err = &ProtocolError{Line: string(lineb)}
 			return
 		}
 
-		rd := make(map[string]string)
-		rd["score"] = string(mb[1])
-		rd["name"] = string(mb[2])
-		rd["description"] = string(mb[3])
+		rs.Rules = append(rs.Rules, newRule(mb))
+	}
+}
 
-		rs.Rules = append(rs.Rules, rd)
+// readRuleLine reads a line from r, some rules are continued on
+// the next line so for ruleRe to match the full rule the continued
+// line is read with it
+func readRuleLine(r *bufio.Reader) (lineb []byte, err error) {
+	if lineb, err = r.ReadBytes('\n'); err != nil {
+		return
+	}
+	if bytes.Equal(lineb, []byte("\n")) || r.Buffered() <= 2 {
+		return
 	}
+	if peek, e := r.Peek(2); e == nil && isASCIISpace(peek[1]) {
+		var next []byte
+		next, err = r.ReadBytes('\n')
+		lineb = append(lineb, next...)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	return
 }
 
-func (c *Client) symbols(tc *textproto.Conn, rs *response.Response) (err error) {
+func (c *Client) symbols(tc *textproto.Conn, rs *response.Response, raw bool) (err error) {
 	var lineb []byte
 	if lineb, err = tc.R.ReadBytes('\n'); err != nil {
 		if err == io.EOF {
@@ -644,17 +1193,27 @@ func (c *Client) symbols(tc *textproto.Conn, rs *response.Response) (err error)
 		}
 	}
 
-	if c.returnRawBody {
+	if raw {
 		rs.Raw = append(rs.Raw, lineb...)
 	}
 
-	for _, rn := range bytes.Split(lineb, []byte(",")) {
-		rd := make(map[string]string)
-		rd["score"] = ""
-		rd["name"] = string(rn)
-		rd["description"] = ""
+	for _, rn := range bytes.Split(bytes.TrimSpace(lineb), []byte(",")) {
+		if len(rn) == 0 {
+			continue
+		}
+		rs.Rules = append(rs.Rules, response.Rule{Name: string(rn)})
+	}
+	return
+}
 
-		rs.Rules = append(rs.Rules, rd)
+// newRule returns a Rule from a ruleRe match, continued
+// description lines are joined with a single space
+func newRule(mb [][]byte) (r response.Rule) {
+	r.Name = string(mb[2])
+	r.Description = strings.Join(strings.Fields(string(mb[3])), " ")
+	if score, err := strconv.ParseFloat(string(mb[1]), 64); err == nil {
+		r.Score = score
+		r.HasScore = true
 	}
 	return
 }
@@ -16,7 +16,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -256,9 +258,24 @@ func TestRootCA(t *testing.T) {
 	}
 	fn = "../examples/data/ham.txt"
 	e = c.SetRootCA(fn)
+	if e == nil {
+		t.Fatalf("Expected an error got nil")
+	}
+	expected := fmt.Sprintf(rootCAParseErr, fn)
+	if e.Error() != expected {
+		t.Errorf("Got %q want %q", e, expected)
+	}
+	if c.rootCA != "" || c.rootCAs != nil {
+		t.Errorf("The RootCA should not be set on error")
+	}
+	fn = "../examples/data/ca-chain.cert.pem"
+	e = c.SetRootCA(fn)
 	if e != nil {
 		t.Fatalf("UnExpected error: %s", e)
 	}
+	if c.rootCAs == nil {
+		t.Errorf("The RootCA pool should be set")
+	}
 	if c.rootCA != fn {
 		t.Errorf("Got %q want %q", c.rootCA, fn)
 	}
@@ -323,6 +340,21 @@ func TestIOReader(t *testing.T) {
 			t.Fatalf("Unexpected error: %s", e)
 		}
 		defer f.Close()
+		if useTLS == "1" {
+			c.SetRootCA(tlsRootCA)
+			c.EnableTLS()
+			c.EnableTLSVerification()
+		}
+		ir = bzip2.NewReader(f)
+		r, e := c.Check(ctx, ir)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if r.StatusCode != response.ExOK {
+			t.Errorf("Got %q want %q", r.StatusCode, response.ExOK)
+		}
+		f.Seek(0, 0)
+		c.DisableSpooling()
 		ir = bzip2.NewReader(f)
 		_, e = c.Check(ctx, ir)
 		if e == nil {
@@ -980,3 +1012,247 @@ func log(t *testing.T, r *response.Response) {
 	t.Logf("RequestMethod:\t%s\nStatusCode:\t%s\nStatusMsg:\t%s\nVersion:\t%s\nScore:\t%v\nBaseScore:\t%v\nIsSpam:\t%t\nHeaders:\t%v\nMsg:\t%v\nRules:\t%v",
 		r.RequestMethod, r.StatusCode, r.StatusMsg, r.Version, r.Score, r.BaseScore, r.IsSpam, r.Headers, r.Msg, r.Rules)
 }
+
+func TestNewRule(t *testing.T) {
+	mb := ruleRe.FindSubmatch([]byte(" 3.5 BAYES_99               BODY: Bayes spam probability is 99 to 100%\n                            [score: 1.0000]"))
+	if mb == nil {
+		t.Fatal("The rule should match")
+	}
+	r := newRule(mb)
+	if r.Name != "BAYES_99" {
+		t.Errorf("Got %q want %q", r.Name, "BAYES_99")
+	}
+	if !r.HasScore || r.Score != 3.5 {
+		t.Errorf("Got %v/%t want %v/%t", r.Score, r.HasScore, 3.5, true)
+	}
+	expected := "BODY: Bayes spam probability is 99 to 100% [score: 1.0000]"
+	if r.Description != expected {
+		t.Errorf("Got %q want %q", r.Description, expected)
+	}
+}
+
+const testReport = "Spam detection software has identified this incoming email as possible spam.\n" +
+	"\n" +
+	"Content analysis details:   (4.5 points, 5.0 required)\n" +
+	"\n" +
+	" pts rule name              description\n" +
+	"---- ---------------------- --------------------------------------------------\n" +
+	" 3.5 BAYES_99               BODY: Bayes spam probability is 99 to 100%\n" +
+	"                            [score: 1.0000]\n" +
+	"-0.0 SPF_PASS               SPF: sender matches SPF record\n" +
+	" 1.0 URIBL_BLACK            Contains an URL listed in the URIBL blacklist\n"
+
+var testReportRules = response.Rules{
+	{Name: "BAYES_99", Score: 3.5, Description: "BODY: Bayes spam probability is 99 to 100% [score: 1.0000]", HasScore: true},
+	{Name: "SPF_PASS", Score: 0, Description: "SPF: sender matches SPF record", HasScore: true},
+	{Name: "URIBL_BLACK", Score: 1.0, Description: "Contains an URL listed in the URIBL blacklist", HasScore: true},
+}
+
+func checkRules(t *testing.T, rules, expected response.Rules) {
+	if len(rules) != len(expected) {
+		t.Fatalf("Got %d want %d rules: %v", len(rules), len(expected), rules)
+	}
+	for i, rule := range expected {
+		if rules[i] != rule {
+			t.Errorf("Got %v want %v", rules[i], rule)
+		}
+	}
+}
+
+func TestReportRules(t *testing.T) {
+	ctx := context.Background()
+	s := newCannedServer(t, fmt.Sprintf("SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: False ; 4.5 / 5.0\r\n\r\n%s", len(testReport), testReport))
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	r, e := c.Report(ctx, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	checkRules(t, r.Rules, testReportRules)
+}
+
+func TestProcessRules(t *testing.T) {
+	ctx := context.Background()
+	body := "Subject: test\r\nX-Spam-Flag: NO\r\n\r\n" + testReport
+	s := newCannedServer(t, fmt.Sprintf("SPAMD/1.5 0 EX_OK\r\nContent-length: %d\r\nSpam: False ; 4.5 / 5.0\r\n\r\n%s", len(body), body))
+	for _, raw := range []bool{false, true} {
+		c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if raw {
+			c.EnableRawBody()
+		}
+		r, e := c.Process(ctx, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		checkRules(t, r.Rules, testReportRules)
+		if raw && string(r.Raw) != body {
+			t.Errorf("Got %q want %q", r.Raw, body)
+		}
+	}
+}
+
+func TestSymbolsRules(t *testing.T) {
+	ctx := context.Background()
+	symbols := "BAYES_99,SPF_PASS,URIBL_BLACK\r\n"
+	s := newCannedServer(t, fmt.Sprintf("SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: True ; 15.0 / 5.0\r\n\r\n%s", len(symbols), symbols))
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	r, e := c.Symbols(ctx, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	expected := response.Rules{
+		{Name: "BAYES_99"},
+		{Name: "SPF_PASS"},
+		{Name: "URIBL_BLACK"},
+	}
+	if len(r.Rules) != len(expected) {
+		t.Fatalf("Got %d want %d rules: %v", len(r.Rules), len(expected), r.Rules)
+	}
+	for i, rule := range expected {
+		if r.Rules[i] != rule {
+			t.Errorf("Got %v want %v", r.Rules[i], rule)
+		}
+	}
+}
+
+// newServer serves a local tcp port with handle, see startServer
+func newServer(t *testing.T, handle func(conn net.Conn)) (l net.Listener) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	startServer(t, l, handle)
+	return
+}
+
+// startServer calls handle for each connection accepted on l in its
+// own goroutine, the connection is closed when handle returns and l
+// when the test ends
+func startServer(t *testing.T, l net.Listener, handle func(conn net.Conn)) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+}
+
+// newHangServer reads requests but never completes the reply, closed
+// receives once the client has closed the connection
+func newHangServer(t *testing.T) (l net.Listener, closed chan struct{}) {
+	closed = make(chan struct{}, 10)
+	l = newServer(t, func(conn net.Conn) {
+		ioutil.ReadAll(conn)
+		// Writes fail once the client has closed the socket
+		for {
+			if _, err := conn.Write([]byte("S")); err != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		closed <- struct{}{}
+	})
+	return
+}
+
+func TestDeadline(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := deadline(ctx, 0); ok {
+		t.Errorf("No deadline should be set")
+	}
+	d, ok := deadline(ctx, time.Minute)
+	if !ok || time.Until(d) > time.Minute {
+		t.Errorf("Got %s want the cmd timeout", d)
+	}
+	tctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	cd, _ := tctx.Deadline()
+	if d, _ = deadline(tctx, time.Minute); !d.Equal(cd) {
+		t.Errorf("Got %s want %s", d, cd)
+	}
+	if d, _ = deadline(tctx, time.Millisecond); d.Equal(cd) {
+		t.Errorf("Got %s want the cmd timeout", d)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	l, closed := newHangServer(t)
+	c, e := NewClient("tcp", l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n"))
+	if e != context.Canceled {
+		t.Errorf("Got %v want %s", e, context.Canceled)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("The request should return once cancelled")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The connection should be closed")
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	l, _ := newHangServer(t)
+	c, e := NewMultiClient([]Endpoint{
+		{Network: "tcp", Address: l.Addr().String()},
+		{Network: "tcp", Address: l.Addr().String()},
+	}, "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n"))
+	if e != context.DeadlineExceeded {
+		t.Errorf("Got %v want %s", e, context.DeadlineExceeded)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("The request should return at the deadline")
+	}
+
+	_, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n"))
+	if e != context.DeadlineExceeded {
+		t.Errorf("Got %v want %s", e, context.DeadlineExceeded)
+	}
+}
+
+func TestProcessRawNoNewline(t *testing.T) {
+	body := "Subject: test\r\nX-Spam-Flag: NO\r\n\r\nno newline"
+	s := newCannedServer(t, "SPAMD/1.5 0 EX_OK\r\nSpam: False ; 1.0 / 5.0\r\n"+
+		"Content-length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.EnableRawBody()
+	rs, e := c.Process(context.Background(), strings.NewReader("Subject: test\r\n\r\nno newline"))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if string(rs.Raw) != body {
+		t.Errorf("Got %q want %q", rs.Raw, body)
+	}
+}
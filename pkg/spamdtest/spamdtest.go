@@ -0,0 +1,372 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package spamdtest provides a fake spamd server for offline tests
+spamd-client - Golang Spamd SpamAssassin Client
+*/
+package spamdtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+	"github.com/baruwa-enterprise/spamd-client/pkg/server"
+)
+
+const (
+	hostname          = "spamdtest"
+	defaultThreshold  = 5.0
+	listenErr         = "spamdtest: failed to listen: %v"
+	alreadyStartedErr = "spamdtest: server already started"
+	certificateErr    = "spamdtest: failed to create certificate: %v"
+)
+
+// A Request is a request received by the Server
+type Request struct {
+	Method  request.Method
+	Version string
+	Header  textproto.MIMEHeader
+	// User is the value of the User header
+	User string
+	// Body is the message as sent, decompressed when Compressed is set
+	Body       []byte
+	Compressed bool
+	// Action and MsgType are set for TELL requests
+	Action  request.TellAction
+	MsgType request.MsgType
+}
+
+// A Result is the outcome of a request returned by a Handler
+type Result struct {
+	// Code is the status, only the status line is sent when it is
+	// not EX_OK
+	Code      response.StatusCode
+	IsSpam    bool
+	Score     float64
+	Threshold float64
+	Rules     response.Rules
+	// Message is returned by PROCESS and HEADERS, the request body
+	// with X-Spam headers added is used when nil
+	Message []byte
+	// Headers are added to the response headers
+	Headers textproto.MIMEHeader
+}
+
+// A Handler returns the Result of a request, a nil Result is
+// treated as a ham result with no rules
+type Handler func(r *Request) *Result
+
+// Canned returns a Handler that returns res for every request
+func Canned(res *Result) Handler {
+	return func(r *Request) *Result {
+		return res
+	}
+}
+
+// A Server is a spamd server listening on a system chosen port
+// or unix socket, for use in end to end tests
+type Server struct {
+	Listener net.Listener
+	Handler  Handler
+	// TLS is the server TLS configuration, set by StartTLS
+	TLS *tls.Config
+
+	certificate *x509.Certificate
+	dir         string
+	started     bool
+	srv         *server.Server
+	done        chan struct{}
+	mu          sync.Mutex
+	requests    []*Request
+}
+
+// NewServer starts and returns a new TCP Server
+func NewServer(h Handler) (s *Server) {
+	s = NewUnstartedServer(h)
+	s.Start()
+	return
+}
+
+// NewTLSServer starts and returns a new TCP Server using TLS
+// with a self signed certificate
+func NewTLSServer(h Handler) (s *Server) {
+	s = NewUnstartedServer(h)
+	s.StartTLS()
+	return
+}
+
+// NewUnixServer starts and returns a new Server listening on a
+// unix socket in a temp directory
+func NewUnixServer(h Handler) (s *Server) {
+	dir, err := ioutil.TempDir("", "spamdtest")
+	if err != nil {
+		panic(fmt.Sprintf(listenErr, err))
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "spamd.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		panic(fmt.Sprintf(listenErr, err))
+	}
+	s = &Server{Listener: l, Handler: h, dir: dir}
+	s.Start()
+	return
+}
+
+// NewUnstartedServer returns a new TCP Server that is not started,
+// its fields can be changed before calling Start or StartTLS
+func NewUnstartedServer(h Handler) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic(fmt.Sprintf(listenErr, err))
+		}
+	}
+	return &Server{Listener: l, Handler: h}
+}
+
+// Start starts the server
+func (s *Server) Start() {
+	if s.started {
+		panic(alreadyStartedErr)
+	}
+	s.started = true
+	s.srv = &server.Server{Handler: server.HandlerFunc(s.serveSPAMD)}
+	s.done = make(chan struct{})
+	go func() {
+		s.srv.Serve(s.Listener)
+		close(s.done)
+	}()
+}
+
+// StartTLS starts the server using TLS, a self signed certificate
+// is created when s.TLS has no certificates
+func (s *Server) StartTLS() {
+	if s.TLS == nil {
+		s.TLS = &tls.Config{}
+	}
+	if len(s.TLS.Certificates) == 0 {
+		cert, err := selfSigned()
+		if err != nil {
+			panic(fmt.Sprintf(certificateErr, err))
+		}
+		s.TLS.Certificates = []tls.Certificate{cert}
+	}
+	s.certificate, _ = x509.ParseCertificate(s.TLS.Certificates[0].Certificate[0])
+	s.Listener = tls.NewListener(s.Listener, s.TLS)
+	s.Start()
+}
+
+// Close shuts down the server and waits for the open connections
+// to finish
+func (s *Server) Close() {
+	if s.srv != nil {
+		s.srv.Shutdown(context.Background())
+		<-s.done
+	} else {
+		s.Listener.Close()
+	}
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// Endpoint returns the endpoint of the server
+func (s *Server) Endpoint() spamdclient.Endpoint {
+	return spamdclient.Endpoint{
+		Network: s.Listener.Addr().Network(),
+		Address: s.Listener.Addr().String(),
+	}
+}
+
+// Certificate returns the certificate used by a TLS server
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// Client returns a client configured to use the server, the
+// server certificate is trusted when the server uses TLS
+func (s *Server) Client(opts ...spamdclient.Option) (*spamdclient.Client, error) {
+	o := []spamdclient.Option{spamdclient.WithEndpoints(s.Endpoint())}
+	if s.certificate != nil {
+		p := x509.NewCertPool()
+		p.AddCert(s.certificate)
+		o = append(o, spamdclient.WithTLS(), spamdclient.WithTLSConfig(&tls.Config{RootCAs: p}))
+	}
+	return spamdclient.NewClientWithOptions(append(o, opts...)...)
+}
+
+// Requests returns the requests received so far
+func (s *Server) Requests() (r []*Request) {
+	s.mu.Lock()
+	r = make([]*Request, len(s.requests))
+	copy(r, s.requests)
+	s.mu.Unlock()
+	return
+}
+
+// LastRequest returns the most recent request or nil
+func (s *Server) LastRequest() (r *Request) {
+	s.mu.Lock()
+	if n := len(s.requests); n > 0 {
+		r = s.requests[n-1]
+	}
+	s.mu.Unlock()
+	return
+}
+
+func (s *Server) serveSPAMD(w server.ResponseWriter, r *server.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteStatus(response.ExIOErr)
+		return
+	}
+	rq := &Request{
+		Method:     r.Method,
+		Version:    r.Version,
+		Header:     r.Header,
+		User:       r.User,
+		Body:       body,
+		Compressed: r.Compressed,
+		Action:     r.Action,
+		MsgType:    r.MsgType,
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, rq)
+	s.mu.Unlock()
+
+	var res *Result
+	if s.Handler != nil {
+		res = s.Handler(rq)
+	}
+	if res == nil {
+		res = &Result{}
+	}
+	writeResult(w, rq, res)
+}
+
+func writeResult(w server.ResponseWriter, rq *Request, res *Result) {
+	w.WriteStatus(res.Code)
+
+	threshold := res.Threshold
+	if threshold == 0 {
+		threshold = defaultThreshold
+	}
+
+	h := w.Header()
+	for k, vs := range res.Headers {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+	switch rq.Method {
+	case request.Ping, request.Skip:
+		return
+	case request.Tell:
+		if v := rq.Header.Get("Set"); v != "" {
+			h.Set("DidSet", v)
+		}
+		if v := rq.Header.Get("Remove"); v != "" {
+			h.Set("DidRemove", v)
+		}
+		return
+	}
+
+	h.Set("Spam", server.SpamHeader(res.IsSpam, res.Score, threshold))
+	switch rq.Method {
+	case request.Symbols:
+		server.WriteSymbols(w, res.Rules)
+	case request.Report:
+		server.WriteReport(w, hostname, res.Score, threshold, res.Rules)
+	case request.ReportIfSpam:
+		if res.IsSpam {
+			server.WriteReport(w, hostname, res.Score, threshold, res.Rules)
+		}
+	case request.Process:
+		w.Write(processed(rq, res, threshold, false))
+	case request.Headers:
+		w.Write(processed(rq, res, threshold, true))
+	}
+}
+
+// processed returns the message with the X-Spam headers added,
+// only the headers are returned when headersOnly is set
+func processed(rq *Request, res *Result, threshold float64, headersOnly bool) []byte {
+	var b bytes.Buffer
+
+	msg := res.Message
+	if msg == nil {
+		names := make([]string, len(res.Rules))
+		for i, r := range res.Rules {
+			names[i] = r.Name
+		}
+		fmt.Fprintf(&b, "X-Spam-Flag: %s\r\n", strings.ToUpper(yesNo(res.IsSpam)))
+		fmt.Fprintf(&b, "X-Spam-Status: %s, score=%.1f required=%.1f tests=%s\r\n",
+			yesNo(res.IsSpam), res.Score, threshold, strings.Join(names, ","))
+		b.Write(rq.Body)
+		msg = b.Bytes()
+	}
+	if headersOnly {
+		if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+			msg = msg[:i+4]
+		}
+	}
+	return msg
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// selfSigned returns a certificate valid for 127.0.0.1, ::1
+// and localhost
+func selfSigned() (cert tls.Certificate, err error) {
+	var der []byte
+	var key *ecdsa.PrivateKey
+
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"spamdtest"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+	if der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key); err != nil {
+		return
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
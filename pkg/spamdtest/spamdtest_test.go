@@ -0,0 +1,204 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	spamdclient "github.com/baruwa-enterprise/spamd-client/pkg"
+	"github.com/baruwa-enterprise/spamd-client/pkg/request"
+	"github.com/baruwa-enterprise/spamd-client/pkg/response"
+)
+
+const testMsg = "From: sender@example.com\r\nSubject: test\r\n\r\nbody\r\n"
+
+var spamResult = &Result{
+	IsSpam: true,
+	Score:  8.2,
+	Rules: response.Rules{
+		{Name: "BAYES_99", Score: 3.5, Description: "BODY: Bayes spam probability is 99 to 100%", HasScore: true},
+		{Name: "URIBL_BLACK", Score: 4.8, Description: "Contains an URL listed in the URIBL blacklist", HasScore: true},
+		{Name: "SPF_PASS", Score: -0.1, HasScore: true},
+	},
+}
+
+func newClient(t *testing.T, s *Server, opts ...spamdclient.Option) *spamdclient.Client {
+	c, e := s.Client(opts...)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	return c
+}
+
+func TestMethods(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(Canned(spamResult))
+	defer s.Close()
+	c := newClient(t, s, spamdclient.WithUser("exim"))
+
+	if ok, e := c.Ping(ctx); e != nil || !ok {
+		t.Fatalf("Unexpected error: %v %t", e, ok)
+	}
+
+	rs, e := c.Check(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if !rs.IsSpam || rs.Score != 8.2 || rs.BaseScore != 5.0 {
+		t.Errorf("Got %t %v/%v want true 8.2/5.0", rs.IsSpam, rs.Score, rs.BaseScore)
+	}
+
+	rs, e = c.Symbols(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if len(rs.Rules) != 3 || rs.Rules[1].Name != "URIBL_BLACK" {
+		t.Errorf("Got %v want the canned rules", rs.Rules)
+	}
+
+	for _, f := range []func(context.Context, *strings.Reader) error{
+		func(ctx context.Context, r *strings.Reader) (err error) {
+			rs, err = c.Report(ctx, r)
+			return
+		},
+		func(ctx context.Context, r *strings.Reader) (err error) {
+			rs, err = c.ReportIfSpam(ctx, r)
+			return
+		},
+	} {
+		if e = f(ctx, strings.NewReader(testMsg)); e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if len(rs.Rules) != 3 {
+			t.Fatalf("Got %d want %d", len(rs.Rules), 3)
+		}
+		r, _ := rs.Rules.Lookup("SPF_PASS")
+		if r.Score != -0.1 || r.Description != "No description available." {
+			t.Errorf("Got %+v", r)
+		}
+	}
+
+	rs, e = c.Process(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if rs.Msg.Header.Get("X-Spam-Flag") != "YES" || rs.Msg.Header.Get("Subject") != "test" {
+		t.Errorf("Got %v want the processed headers", rs.Msg.Header)
+	}
+	if !bytes.Contains(rs.Msg.Body, []byte("body")) {
+		t.Errorf("Got %q want the message body", rs.Msg.Body)
+	}
+
+	rs, e = c.Headers(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if !strings.HasPrefix(rs.Msg.Header.Get("X-Spam-Status"), "Yes, score=8.2") || len(rs.Msg.Body) != 0 {
+		t.Errorf("Got %v %q want only the headers", rs.Msg.Header, rs.Msg.Body)
+	}
+
+	rs, e = c.Learn(ctx, strings.NewReader(testMsg), request.Spam)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if rs.Headers.Get("DidSet") != "local" {
+		t.Errorf("Got %v want DidSet", rs.Headers)
+	}
+
+	rq := s.Requests()
+	if len(rq) != 8 {
+		t.Fatalf("Got %d want %d", len(rq), 8)
+	}
+	expected := []request.Method{
+		request.Ping, request.Check, request.Symbols, request.Report, request.ReportIfSpam,
+		request.Process, request.Headers, request.Tell,
+	}
+	for i, m := range expected {
+		if rq[i].Method != m {
+			t.Errorf("Got %q want %q", rq[i].Method, m)
+		}
+	}
+	last := s.LastRequest()
+	if last.Method != request.Tell || last.Action != request.LearnAction || last.MsgType != request.Spam {
+		t.Errorf("Got %q %v %v want a TELL learn spam request", last.Method, last.Action, last.MsgType)
+	}
+	if rq[1].User != "exim" || !bytes.HasPrefix(rq[1].Body, []byte(testMsg)) {
+		t.Errorf("Got %q %q want the user and message", rq[1].User, rq[1].Body)
+	}
+}
+
+func TestTellActions(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(nil)
+	defer s.Close()
+	c := newClient(t, s)
+
+	tests := []struct {
+		l request.MsgType
+		a request.TellAction
+	}{
+		{request.Ham, request.LearnAction},
+		{request.Spam, request.ForgetAction},
+		{request.Spam, request.ReportAction},
+		{request.Ham, request.RevokeAction},
+	}
+	for _, tt := range tests {
+		if _, e := c.Tell(ctx, strings.NewReader(testMsg), tt.l, tt.a); e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if a := s.LastRequest().Action; a != tt.a {
+			t.Errorf("Got %v want %v", a, tt.a)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(func(r *Request) *Result {
+		if r.User == "blocked" {
+			return &Result{Code: response.ExNoPerm}
+		}
+		return &Result{Score: float64(len(r.Body))}
+	})
+	defer s.Close()
+
+	c := newClient(t, s, spamdclient.WithUser("blocked"))
+	_, e := c.Check(ctx, strings.NewReader(testMsg))
+	if !errors.Is(e, response.ExNoPerm) {
+		t.Errorf("Got %v want %s", e, response.ExNoPerm)
+	}
+
+	c = newClient(t, s, spamdclient.WithUser("exim"), spamdclient.WithCompression())
+	rs, e := c.Check(ctx, strings.NewReader(testMsg))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if rs.Score != float64(len(testMsg)) {
+		t.Errorf("Got %v want %d", rs.Score, len(testMsg))
+	}
+	if rq := s.LastRequest(); !rq.Compressed || string(rq.Body) != testMsg {
+		t.Errorf("Got %t %q want the decompressed message", rq.Compressed, rq.Body)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	ctx := context.Background()
+	for _, s := range []*Server{NewUnixServer(Canned(spamResult)), NewTLSServer(Canned(spamResult))} {
+		c := newClient(t, s)
+		rs, e := c.Check(ctx, strings.NewReader(testMsg))
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if !rs.IsSpam {
+			t.Errorf("Got %t want %t", rs.IsSpam, true)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	defaultSpoolThreshold int64 = 1024 * 1024
+	spoolPrefix                 = "spamd-client-"
+)
+
+type readerWithLen interface {
+	Len() int
+}
+
+type readerAtWithSize interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// body is a request body with a known length, start is the
+// offset to rewind to or -1 when the body can not be rewound
+type body struct {
+	r          io.Reader
+	size       int64
+	start      int64
+	compressed bool
+	cleanup    func()
+}
+
+// newBody determines the length of r, readers of unknown length
+// are spooled to memory or to a temp file when spooling is enabled
+func (s *settings) newBody(r io.Reader) (b *body, err error) {
+	var ok bool
+
+	if b, ok, err = sizeOf(r); err != nil || ok {
+		return
+	}
+
+	if !s.useSpool {
+		err = ErrNoSize
+		return
+	}
+
+	b, err = s.spool(r)
+	return
+}
+
+// sizeOf sizes r without copying it, ok is false when the
+// size can not be determined
+func sizeOf(r io.Reader) (b *body, ok bool, err error) {
+	var pos, end int64
+	var stat os.FileInfo
+
+	switch v := r.(type) {
+	case readerWithLen:
+		b = &body{r: r, size: int64(v.Len()), start: -1}
+		if s, isSeeker := r.(io.Seeker); isSeeker {
+			if pos, err = s.Seek(0, io.SeekCurrent); err != nil {
+				return
+			}
+			b.start = pos
+		}
+		ok = true
+		return
+	case *os.File:
+		// pipes, sockets and terminals report no usable size
+		if stat, err = v.Stat(); err != nil {
+			return
+		}
+		if !stat.Mode().IsRegular() {
+			return
+		}
+		if pos, err = v.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+		b = &body{r: r, size: stat.Size() - pos, start: pos}
+		ok = true
+		return
+	case io.Seeker:
+		if pos, err = v.Seek(0, io.SeekCurrent); err != nil {
+			// not seekable after all, spool it
+			err = nil
+			return
+		}
+		if end, err = v.Seek(0, io.SeekEnd); err != nil {
+			return
+		}
+		if _, err = v.Seek(pos, io.SeekStart); err != nil {
+			return
+		}
+		b = &body{r: r, size: end - pos, start: pos}
+		ok = true
+		return
+	case readerAtWithSize:
+		sr := io.NewSectionReader(v, 0, v.Size())
+		b = &body{r: sr, size: sr.Size(), start: 0}
+		ok = true
+		return
+	}
+	return
+}
+
+// spool copies r to memory, switching to a temp file once the
+// spool threshold is exceeded
+func (s *settings) spool(r io.Reader) (b *body, err error) {
+	var n int64
+	var f *os.File
+	var buf bytes.Buffer
+
+	if n, err = io.CopyN(&buf, r, s.spoolThreshold+1); err != nil && err != io.EOF {
+		return
+	}
+
+	if n <= s.spoolThreshold {
+		err = nil
+		b = &body{r: bytes.NewReader(buf.Bytes()), size: n, start: 0}
+		return
+	}
+
+	if f, err = ioutil.TempFile(s.spoolDir, spoolPrefix); err != nil {
+		return
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err = buf.WriteTo(f); err != nil {
+		cleanup()
+		return
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		cleanup()
+		return
+	}
+	if n, err = f.Seek(0, io.SeekCurrent); err != nil {
+		cleanup()
+		return
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return
+	}
+
+	b = &body{r: f, size: n, start: 0, cleanup: cleanup}
+	return
+}
+
+// rewindable makes sure the body can be resent, spooling
+// the remainder of a body that can not be rewound
+func (s *settings) rewindable(b *body) (err error) {
+	var sb *body
+
+	if b.start >= 0 {
+		return
+	}
+
+	if sb, err = s.spool(b.r); err != nil {
+		return
+	}
+	*b = *sb
+	return
+}
+
+// rewind seeks the body back to where it started
+func (b *body) rewind() (err error) {
+	if b.start < 0 {
+		err = fmt.Errorf(noRewindErr)
+		return
+	}
+	_, err = b.r.(io.Seeker).Seek(b.start, io.SeekStart)
+	return
+}
+
+// Close removes the temp file used to spool the body
+func (b *body) Close() {
+	if b.cleanup != nil {
+		b.cleanup()
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type checkRequest struct {
+	header  textproto.MIMEHeader
+	body    []byte
+	trailer []byte
+}
+
+type checkServer struct {
+	l        net.Listener
+	reply    string
+	mu       sync.Mutex
+	requests []checkRequest
+}
+
+// newCheckServer answers CHECK requests and records them
+func newCheckServer(t *testing.T) (s *checkServer) {
+	s = newCannedServer(t, "SPAMD/1.5 0 EX_OK\r\nSpam: False ; 1.0 / 5.0\r\n\r\n")
+	return
+}
+
+// newCannedServer answers every request with reply and records them
+func newCannedServer(t *testing.T, reply string) (s *checkServer) {
+	s = &checkServer{reply: reply}
+	s.l = newServer(t, s.serve)
+	return
+}
+
+// startCannedServer serves l answering every request with reply
+func startCannedServer(t *testing.T, l net.Listener, reply string) (s *checkServer) {
+	s = &checkServer{l: l, reply: reply}
+	startServer(t, l, s.serve)
+	return
+}
+
+func (s *checkServer) serve(conn net.Conn) {
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	if _, err := tp.ReadLine(); err != nil {
+		return
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	n, err := strconv.Atoi(h.Get("Content-length"))
+	if err != nil {
+		return
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(tp.R, b); err != nil {
+		return
+	}
+	trailer, _ := ioutil.ReadAll(tp.R)
+	s.mu.Lock()
+	s.requests = append(s.requests, checkRequest{header: h, body: b, trailer: trailer})
+	s.mu.Unlock()
+	conn.Write([]byte(s.reply))
+}
+
+func (s *checkServer) Requests() (r []checkRequest) {
+	s.mu.Lock()
+	r = s.requests
+	s.mu.Unlock()
+	return
+}
+
+func TestSizeOf(t *testing.T) {
+	msg := "Subject: test\r\n\r\nbody\r\n"
+	sr := strings.NewReader(msg)
+	sr.Seek(9, io.SeekStart)
+	b, ok, e := sizeOf(sr)
+	if e != nil || !ok {
+		t.Fatalf("Unexpected error: %v %t", e, ok)
+	}
+	if b.size != int64(len(msg)-9) || b.start != 9 {
+		t.Errorf("Got %d/%d want %d/%d", b.size, b.start, len(msg)-9, 9)
+	}
+
+	b, ok, e = sizeOf(bytes.NewBufferString(msg))
+	if e != nil || !ok {
+		t.Fatalf("Unexpected error: %v %t", e, ok)
+	}
+	if b.size != int64(len(msg)) || b.start != -1 {
+		t.Errorf("Got %d/%d want %d/%d", b.size, b.start, len(msg), -1)
+	}
+
+	b, ok, e = sizeOf(io.NewSectionReader(strings.NewReader(msg), 4, 10))
+	if e != nil || !ok {
+		t.Fatalf("Unexpected error: %v %t", e, ok)
+	}
+	if b.size != 10 {
+		t.Errorf("Got %d want %d", b.size, 10)
+	}
+
+	ra := struct {
+		io.Reader
+		io.ReaderAt
+		sizer
+	}{strings.NewReader(""), strings.NewReader(msg), sizer(len(msg))}
+	b, ok, e = sizeOf(ra)
+	if e != nil || !ok {
+		t.Fatalf("Unexpected error: %v %t", e, ok)
+	}
+	if b.size != int64(len(msg)) {
+		t.Errorf("Got %d want %d", b.size, len(msg))
+	}
+
+	f, e := getFile(false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer f.Close()
+	st, _ := f.Stat()
+	f.Seek(10, io.SeekStart)
+	b, ok, e = sizeOf(f)
+	if e != nil || !ok {
+		t.Fatalf("Unexpected error: %v %t", e, ok)
+	}
+	if b.size != st.Size()-10 || b.start != 10 {
+		t.Errorf("Got %d/%d want %d/%d", b.size, b.start, st.Size()-10, 10)
+	}
+
+	pr, pw, e := os.Pipe()
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer pr.Close()
+	pw.Close()
+	if _, ok, e = sizeOf(pr); e != nil || ok {
+		t.Errorf("A pipe should not be sized: %v %t", e, ok)
+	}
+
+	if _, ok, e = sizeOf(io.MultiReader(strings.NewReader(msg))); e != nil || ok {
+		t.Errorf("A multireader should not be sized: %v %t", e, ok)
+	}
+}
+
+type sizer int64
+
+func (s sizer) Size() int64 {
+	return int64(s)
+}
+
+func TestSpool(t *testing.T) {
+	c, e := NewClient("tcp", "127.1.1.1:4010", "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	dir, e := ioutil.TempDir("", "spool")
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	defer os.RemoveAll(dir)
+	c.SetSpoolDir(dir)
+
+	msg := strings.Repeat("spamd-client\r\n", 100)
+
+	// memory
+	b, e := c.newBody(io.MultiReader(strings.NewReader(msg)))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if b.size != int64(len(msg)) || b.cleanup != nil {
+		t.Errorf("Got %d want %d in memory", b.size, len(msg))
+	}
+	b.Close()
+
+	// temp file
+	c.SetSpoolThreshold(64)
+	b, e = c.newBody(io.MultiReader(strings.NewReader(msg)))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if b.size != int64(len(msg)) || b.cleanup == nil {
+		t.Errorf("Got %d want %d in a temp file", b.size, len(msg))
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Got %d want %d temp files", len(files), 1)
+	}
+	got, _ := ioutil.ReadAll(b.r)
+	if string(got) != msg {
+		t.Errorf("The spooled message does not match")
+	}
+	if e = b.rewind(); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	b.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Got %d want %d temp files", len(files), 0)
+	}
+
+	// disabled
+	c.DisableSpooling()
+	if _, e = c.newBody(io.MultiReader(strings.NewReader(msg))); e == nil || e.Error() != noSizeErr {
+		t.Errorf("Got %v want %s", e, noSizeErr)
+	}
+}
+
+func TestSpoolRequest(t *testing.T) {
+	ctx := context.Background()
+	s := newCheckServer(t)
+	c, e := NewClient("tcp", s.l.Addr().String(), "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.SetSpoolThreshold(16)
+	msg := "Subject: spooled\r\n\r\nA message of unknown length\r\n"
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte(msg))
+		pw.Close()
+	}()
+	if _, e = c.Check(ctx, pr); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	rq := s.Requests()
+	if len(rq) != 1 {
+		t.Fatalf("Got %d want %d requests", len(rq), 1)
+	}
+	if string(rq[0].body) != msg+"\r\n" {
+		t.Errorf("Got %q want %q", rq[0].body, msg+"\r\n")
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	pinPrefix           = "sha256/"
+	rootCAParseErr      = "The RootCA file: %s does not contain a valid certificate"
+	tlsVersionErr       = "TLS version: %s is not supported"
+	tlsVersionRangeErr  = "The minimum TLS version is greater than the maximum"
+	invalidPinErr       = "Invalid SPKI pin: %s"
+	pinMismatchErr      = "The server certificate does not match any pinned key"
+	clientCertLoadErr   = "Failed to load the client certificate: %s"
+	clientCertMissedErr = "Both the client certificate and key are required"
+)
+
+var tlsVersions = map[string]uint16{
+	"1":   tls.VersionTLS10,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version such as tlsv1.2 or 1.2 to
+// the matching crypto/tls constant
+func ParseTLSVersion(s string) (v uint16, err error) {
+	n := strings.TrimPrefix(strings.ToLower(s), "tlsv")
+	v, ok := tlsVersions[n]
+	if !ok {
+		err = fmt.Errorf(tlsVersionErr, s)
+	}
+	return
+}
+
+// PinFor returns the SPKI pin of cert in the form accepted by
+// SetPinnedKeys
+func PinFor(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func loadRootCA(p string) (pool *x509.CertPool, err error) {
+	var s os.FileInfo
+	var ca []byte
+
+	if s, err = os.Stat(p); err != nil {
+		return
+	}
+	if s.Size() > maxCertSize {
+		err = fmt.Errorf(rootCASizeErr, p, maxCertSize)
+		return
+	}
+	if ca, err = ioutil.ReadFile(p); err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		pool = nil
+		err = fmt.Errorf(rootCAParseErr, p)
+	}
+	return
+}
+
+func loadClientCert(certFile, keyFile string) (certs []tls.Certificate, err error) {
+	var cert tls.Certificate
+
+	if certFile == "" || keyFile == "" {
+		err = fmt.Errorf(clientCertMissedErr)
+		return
+	}
+	if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		err = fmt.Errorf(clientCertLoadErr, err)
+		return
+	}
+	certs = []tls.Certificate{cert}
+	return
+}
+
+func checkTLSVersions(min, max uint16) (err error) {
+	for _, v := range []uint16{min, max} {
+		if v != 0 && (v < tls.VersionTLS10 || v > tls.VersionTLS13) {
+			err = fmt.Errorf(tlsVersionErr, fmt.Sprintf("%#x", v))
+			return
+		}
+	}
+	if min != 0 && max != 0 && min > max {
+		err = fmt.Errorf(tlsVersionRangeErr)
+	}
+	return
+}
+
+func parsePins(pins []string) (hashes [][]byte, err error) {
+	var h []byte
+
+	for _, p := range pins {
+		h, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(p, pinPrefix))
+		if err != nil || len(h) != sha256.Size {
+			hashes = nil
+			err = fmt.Errorf(invalidPinErr, p)
+			return
+		}
+		hashes = append(hashes, h)
+	}
+	return
+}
+
+// verifyPins returns a VerifyConnection function that requires one of
+// the peer certificates to match a pin, next is called when set
+func verifyPins(pins [][]byte, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) (err error) {
+		if next != nil {
+			if err = next(cs); err != nil {
+				return
+			}
+		}
+		for _, cert := range cs.PeerCertificates {
+			h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, p := range pins {
+				if bytes.Equal(h[:], p) {
+					return
+				}
+			}
+		}
+		err = fmt.Errorf(pinMismatchErr)
+		return
+	}
+}
+
+// SetClientCert sets the certificate and key presented to spamd
+// when it is configured with --ssl-verify-client
+func (c *Client) SetClientCert(certFile, keyFile string) (err error) {
+	var certs []tls.Certificate
+
+	if certs, err = loadClientCert(certFile, keyFile); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.certificates = certs
+	return
+}
+
+// SetTLSVersion sets the minimum and maximum TLS versions,
+// zero leaves the crypto/tls default in place
+func (c *Client) SetTLSVersion(min, max uint16) (err error) {
+	if err = checkTLSVersions(min, max); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.minTLSVersion = min
+	c.maxTLSVersion = max
+	return
+}
+
+// SetServerName sets the name used to verify the server certificate,
+// by default the host part of the endpoint address is used
+func (c *Client) SetServerName(n string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.serverName = n
+}
+
+// SetPinnedKeys pins the server certificate to the base64 encoded
+// SHA-256 hashes of its SubjectPublicKeyInfo. The pins are checked in
+// addition to the usual verification unless it has been disabled.
+func (c *Client) SetPinnedKeys(pins ...string) (err error) {
+	var hashes [][]byte
+
+	if hashes, err = parsePins(pins); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pins = hashes
+	return
+}
+
+// SetTLSConfig sets the tls.Config used as the base of the TLS
+// settings, the other TLS setters override its fields when set.
+func (c *Client) SetTLSConfig(conf *tls.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tlsConf = nil
+	if conf != nil {
+		c.tlsConf = conf.Clone()
+	}
+}
+
+func (c *Client) tlsConfig(s *settings) (conf *tls.Config) {
+	if s.tlsConf != nil {
+		conf = s.tlsConf.Clone()
+	} else {
+		conf = &tls.Config{}
+	}
+
+	if conf.ClientSessionCache == nil {
+		conf.ClientSessionCache = c.sessionCache
+	}
+	if s.insecureSkipVerify {
+		conf.InsecureSkipVerify = true
+	}
+	if s.rootCAs != nil {
+		conf.RootCAs = s.rootCAs
+	}
+	if len(s.certificates) > 0 {
+		conf.Certificates = s.certificates
+	}
+	if s.minTLSVersion != 0 {
+		conf.MinVersion = s.minTLSVersion
+	}
+	if s.maxTLSVersion != 0 {
+		conf.MaxVersion = s.maxTLSVersion
+	}
+	if s.serverName != "" {
+		conf.ServerName = s.serverName
+	}
+	if len(s.pins) > 0 {
+		conf.VerifyConnection = verifyPins(s.pins, conf.VerifyConnection)
+	}
+
+	return
+}
@@ -0,0 +1,186 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spamdclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const (
+	testCA   = "../examples/data/ca-chain.cert.pem"
+	testCert = "../examples/data/localhost.pem"
+	testKey  = "../examples/data/localhost.key.pem"
+)
+
+// newTLSServer answers CHECK requests over TLS, client certificates
+// signed by the test CA are required when verifyClient is set
+func newTLSServer(t *testing.T, verifyClient bool) (s *checkServer) {
+	cert, e := tls.LoadX509KeyPair(testCert, testKey)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if verifyClient {
+		if conf.ClientCAs, e = loadRootCA(testCA); e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	l, e := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	s = startCannedServer(t, l, "SPAMD/1.5 0 EX_OK\r\nSpam: False ; 1.0 / 5.0\r\n\r\n")
+	return
+}
+
+func testPin(t *testing.T) string {
+	b, e := ioutil.ReadFile(testCert)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	p, _ := pem.Decode(b)
+	cert, e := x509.ParseCertificate(p.Bytes)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	return PinFor(cert)
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := map[string]uint16{
+		"tlsv1":   tls.VersionTLS10,
+		"TLSv1.1": tls.VersionTLS11,
+		"tlsv1.2": tls.VersionTLS12,
+		"1.3":     tls.VersionTLS13,
+	}
+	for s, expected := range tests {
+		v, e := ParseTLSVersion(s)
+		if e != nil {
+			t.Fatalf("Unexpected error: %s", e)
+		}
+		if v != expected {
+			t.Errorf("Got %#x want %#x for %s", v, expected, s)
+		}
+	}
+	if _, e := ParseTLSVersion("sslv3"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	c, e := NewClient("tcp", "127.1.1.1:4010", "exim", false)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if e = c.SetTLSVersion(tls.VersionTLS13, tls.VersionTLS12); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if e = c.SetTLSVersion(0x0300, 0); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if e = c.SetPinnedKeys("bad"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if e = c.SetClientCert(testCert, ""); e == nil {
+		t.Errorf("An error should be returned")
+	}
+	if e = c.SetClientCert(testCert, "../examples/data/ham.txt"); e == nil {
+		t.Errorf("An error should be returned")
+	}
+
+	c.SetTLSConfig(&tls.Config{NextProtos: []string{"spamd"}, MinVersion: tls.VersionTLS11})
+	conf := c.tlsConfig(&c.settings)
+	if conf.MinVersion != tls.VersionTLS11 || len(conf.NextProtos) != 1 {
+		t.Errorf("The custom tls.Config should be used: %+v", conf)
+	}
+	if conf.ClientSessionCache == nil || conf.VerifyConnection != nil {
+		t.Errorf("Unexpected tls.Config: %+v", conf)
+	}
+
+	if e = c.SetTLSVersion(tls.VersionTLS12, tls.VersionTLS13); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if e = c.SetClientCert(testCert, testKey); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if e = c.SetPinnedKeys(pinPrefix + testPin(t)); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	c.SetServerName("spamd.example.com")
+	conf = c.tlsConfig(&c.settings)
+	if conf.MinVersion != tls.VersionTLS12 || conf.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("Got %#x-%#x want %#x-%#x", conf.MinVersion, conf.MaxVersion, tls.VersionTLS12, tls.VersionTLS13)
+	}
+	if conf.ServerName != "spamd.example.com" || len(conf.Certificates) != 1 || conf.VerifyConnection == nil {
+		t.Errorf("The TLS settings were not applied: %+v", conf)
+	}
+	if len(conf.NextProtos) != 1 {
+		t.Errorf("The custom tls.Config should be kept: %+v", conf)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ctx := context.Background()
+	s := newTLSServer(t, true)
+	opts := []Option{
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithTLS(),
+		WithRootCA(testCA),
+		WithServerName("localhost"),
+		WithTLSVersion(tls.VersionTLS12, 0),
+	}
+	c, e := NewClientWithOptions(append(opts, WithClientCert(testCert, testKey))...)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	rs, e := c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n"))
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if rs.Score != 1.0 {
+		t.Errorf("Got %v want %v", rs.Score, 1.0)
+	}
+
+	c, e = NewClientWithOptions(opts...)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n")); e == nil {
+		t.Errorf("An error should be returned without a client certificate")
+	}
+}
+
+func TestPinnedKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newTLSServer(t, false)
+	c, e := NewClientWithOptions(
+		WithEndpoint("tcp", s.l.Addr().String()),
+		WithTLS(),
+		WithInsecureSkipVerify(),
+		WithPinnedKeys(testPin(t)),
+	)
+	if e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if _, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n")); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+
+	if e = c.SetPinnedKeys("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="); e != nil {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	_, e = c.Check(ctx, strings.NewReader("Subject: test\r\n\r\n"))
+	if e == nil || !strings.Contains(e.Error(), pinMismatchErr) {
+		t.Errorf("Got %v want %s", e, pinMismatchErr)
+	}
+}